@@ -2,24 +2,42 @@ package main
 
 import (
 	"context"
+	"crypto/sha1"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/golang/glog"
+	"github.com/q3k/webled/work"
 	"io/ioutil"
+	"net/url"
 	"os"
 	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 )
 
 const (
-	kVideoMetaDir = "/var/webled/meta"
-	kVideoDataDir = "/var/webled/data"
+	// Directories within the library root for the metadata, converted data
+	// and thumbnails of videos. Thumbnails and previews are served under
+	// kThumbnailPath.
+	kVideoMetaDir  = "meta"
+	kVideoDataDir  = "data"
+	kVideoThumbDir = "thumbnails"
+	kThumbnailPath = "/thumbnails/"
+	// How much of a video needs to be converted before it starts playing.
+	kPlayableSize = 1024 * 1024
 )
 
 type WebMeta struct {
 	FullTitle string `json:"fulltitle"`
 	ID        string `json:"id"`
+	// Added to youtube-dl's metadata when the audio got normalized.
+	Loudness *work.Loudness `json:"webled_loudness,omitempty"`
 }
 
 func getWebMeta(uri string) ([]byte, *WebMeta, error) {
@@ -41,56 +59,329 @@ type LibraryEntry struct {
 	File      string
 	ID        string
 	SourceURL string
+	// Profiles the video has been converted with.
+	Profiles []string
+	// Loudness of the video before it got normalized, if it was.
+	Loudness *work.Loudness
+	// URLs of the thumbnail and animated preview of the video, if any.
+	Thumbnail string
+	Preview   string
+}
+
+// acquisition is a video being downloaded and converted, along with everyone
+// waiting for it.
+type acquisition struct {
+	uids      []int64
+	callbacks []Callback
 }
 
 type Librarian struct {
+	// Where the library is kept, see Start.
+	metaDir  string
+	dataDir  string
+	thumbDir string
+
+	mutex sync.Mutex
+	// Acquisitions in flight by video ID.
+	inFlight map[string]*acquisition
+	// Latest thumbnail work by video ID, see thumbnail.
+	thumbnails map[string]int64
 }
 
-type Callback func(string, string)
+// NewLibrarian returns a Librarian keeping the library in directories under
+// root.
+func NewLibrarian(root string) *Librarian {
+	return &Librarian{
+		metaDir:    filepath.Join(root, kVideoMetaDir),
+		dataDir:    filepath.Join(root, kVideoDataDir),
+		thumbDir:   filepath.Join(root, kVideoThumbDir),
+		inFlight:   make(map[string]*acquisition),
+		thumbnails: make(map[string]int64),
+	}
+}
 
-func (l *Librarian) Start() error {
-	if err := os.Mkdir(kVideoMetaDir, 0755); err != nil {
-		return err
+// Callback is called with the title and path of an acquired video once it can
+// be played, or with the error that prevented that.
+type Callback func(string, string, error)
+
+// join attaches a callback to an acquisition in flight, returning its work
+// UIDs. The work is bumped to the given priority if needed. Called with the
+// mutex held.
+func (l *Librarian) join(id string, priority work.Priority, c Callback) ([]int64, bool) {
+	a, ok := l.inFlight[id]
+	if !ok {
+		return nil, false
+	}
+	glog.Infof("Video %s already being acquired, waiting for it.", id)
+	a.callbacks = append(a.callbacks, c)
+	overlord.RaisePriority(a.uids, priority)
+	return a.uids, true
+}
+
+// complete triggers the callbacks of an acquisition.
+func (l *Librarian) complete(id string, title, path string, err error) {
+	l.mutex.Lock()
+	a := l.inFlight[id]
+	delete(l.inFlight, id)
+	l.mutex.Unlock()
+	if a == nil {
+		return
+	}
+	for _, c := range a.callbacks {
+		go c(title, path, err)
+	}
+}
+
+// playerRendition picks the rendition the Player will play out of those
+// requested, returning the UID of its conversion from uids as returned by
+// the Overlord, and its path.
+func playerRendition(uids []int64, renditions []work.Rendition) (int64, string) {
+	i := 0
+	for j, r := range renditions {
+		if r.Profile == player.Profile() {
+			i = j
+			break
+		}
+		if r.Profile == work.DefaultProfile {
+			i = j
+		}
+	}
+	return uids[1+i], renditions[i].TargetPath
+}
+
+// addLoudness adds the loudness measured into loudnessFile, if any, to the
+// metadata of a video.
+func addLoudness(metaBytes []byte, loudnessFile string) ([]byte, error) {
+	if loudnessFile == "" {
+		return metaBytes, nil
+	}
+	loudness, err := work.LoadLoudness(loudnessFile)
+	if err != nil {
+		// Nothing measured, eg. because the video is silent.
+		return metaBytes, nil
+	}
+	// Keep everything youtube-dl told us.
+	meta := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(metaBytes, &meta); err != nil {
+		return nil, err
+	}
+	if meta["webled_loudness"], err = json.Marshal(loudness); err != nil {
+		return nil, err
+	}
+	return json.Marshal(meta)
+}
+
+// discard gives up on an acquisition: work still running for it is cancelled
+// and whatever it wrote to the library is removed, including partial
+// renditions, so that it can be acquired again from scratch.
+func (l *Librarian) discard(uids []int64, metaFile, dataFile, loudnessFile string) {
+	for _, uid := range uids {
+		// Fails for work that is done already, which is fine.
+		overlord.Cancel(uid)
+	}
+	os.Remove(metaFile)
+	for _, r := range overlord.Renditions(dataFile) {
+		os.Remove(r.TargetPath)
+	}
+	if loudnessFile != "" {
+		os.Remove(loudnessFile)
+	}
+}
+
+// await follows the conversion of the rendition of an acquisition the Player
+// will play, saving its meta, along with the loudness measured into
+// loudnessFile if not empty, and triggering its callbacks once the converted
+// file is playable: either when the conversion is done, or as soon as it
+// wrote playableSize bytes, if not zero. In the latter case the Player is
+// told that the file is still growing until the conversion is done. If it
+// fails, the acquisition is discarded.
+func (l *Librarian) await(id string, uids []int64, convertUID int64, playableSize int64, title, metaFile, dataFile, renditionFile, loudnessFile string, metaBytes []byte) {
+	events, unsubscribe, err := overlord.Subscribe(convertUID)
+	if err != nil {
+		l.discard(uids, metaFile, dataFile, loudnessFile)
+		l.complete(id, title, dataFile, err)
+		return
+	}
+	defer unsubscribe()
+	playable := false
+	for ev := range events {
+		if ev.Done && !ev.Success {
+			glog.Errorf("Could not acquire %s: %v", id, ev.Error)
+			err := errors.New("Conversion failed.")
+			if ev.Error != nil {
+				err = fmt.Errorf("Conversion failed: %s", ev.Error.Message)
+			}
+			l.discard(uids, metaFile, dataFile, loudnessFile)
+			if playable {
+				player.SetGrowing(renditionFile, false)
+			}
+			l.complete(id, title, dataFile, err)
+			return
+		}
+		if playable {
+			if ev.Done {
+				player.SetGrowing(renditionFile, false)
+			}
+			continue
+		}
+		if ev.Done || (playableSize > 0 && ev.Progress.Size >= playableSize) {
+			// Conversion only starts once loudness has been measured.
+			metaBytes, err := addLoudness(metaBytes, loudnessFile)
+			if err == nil {
+				err = ioutil.WriteFile(metaFile, metaBytes, 0644)
+			}
+			if err != nil {
+				l.discard(uids, metaFile, dataFile, loudnessFile)
+				l.complete(id, title, dataFile, err)
+				return
+			}
+			playable = true
+			if !ev.Done {
+				player.SetGrowing(renditionFile, true)
+			}
+			l.complete(id, title, dataFile, nil)
+		}
+	}
+}
+
+// thumbnail makes a thumbnail, and a preview if enabled, of the video with
+// the given ID from its largest rendition. Given the UIDs of its acquisition
+// as returned by the Overlord, this happens once that rendition is converted,
+// otherwise from the largest rendition present. Nothing happens while
+// thumbnail work for the video is still pending. Thumbnails are not urgent,
+// so they are made in the background, and failures are only logged. Called
+// with the mutex held.
+func (l *Librarian) thumbnail(ctx context.Context, id, dataFile string, uids []int64) {
+	if uid, ok := l.thumbnails[id]; ok {
+		if ws := overlord.GetWorkStatus([]int64{uid}); len(ws) == 1 && !ws[0].Done {
+			return
+		}
+	}
+	source := ""
+	after := []int64{}
+	area := 0
+	for i, r := range overlord.Renditions(dataFile) {
+		p := overlord.Profiles[r.Profile]
+		if p.Width*p.Height <= area {
+			continue
+		}
+		if uids != nil {
+			after = []int64{uids[1+i]}
+		} else if _, err := os.Stat(r.TargetPath); err != nil {
+			continue
+		}
+		source = r.TargetPath
+		area = p.Width * p.Height
+	}
+	if source == "" {
+		glog.Errorf("Could not make thumbnail of %s: no rendition present.", id)
+		return
+	}
+	preview := ""
+	if thumbnailPreviews {
+		preview = fmt.Sprintf("%s/%s.gif", l.thumbDir, id)
 	}
-	if err := os.Mkdir(kVideoDataDir, 0755); err != nil {
-		return err
+	target := fmt.Sprintf("%s/%s.png", l.thumbDir, id)
+	uid, err := overlord.Thumbnail(ctx, source, target, preview, after, work.PRIORITY_BACKGROUND)
+	if err != nil {
+		glog.Errorf("Could not make thumbnail of %s: %v", id, err)
+		return
+	}
+	l.thumbnails[id] = uid
+}
+
+// thumbnailURL returns where the thumbnail or preview of a video with the
+// given extension is served, or an empty string if there is none.
+func (l *Librarian) thumbnailURL(id, ext string) string {
+	name := id + ext
+	if _, err := os.Stat(filepath.Join(l.thumbDir, name)); err != nil {
+		return ""
+	}
+	return kThumbnailPath + url.PathEscape(name)
+}
+
+// Start creates the directories of the library, if they do not exist yet,
+// and abandons acquisitions resumed from the work journal.
+func (l *Librarian) Start() error {
+	for _, dir := range []string{l.metaDir, l.dataDir, l.thumbDir} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
 	}
+	l.abandonResumed()
+	l.backfillThumbnails()
 	return nil
 }
 
-func (l *Librarian) AcquireAndPlay(ctx context.Context, uri string, c Callback) ([]int64, error) {
+// backfillThumbnails makes thumbnails of videos that do not have one, like
+// those acquired before there were any.
+func (l *Librarian) backfillThumbnails() {
+	videos, err := l.GetVideos(context.Background())
+	if err != nil {
+		glog.Errorf("Could not list videos to make thumbnails of: %v", err)
+		return
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for _, v := range videos {
+		if v.Thumbnail == "" {
+			l.thumbnail(context.Background(), v.ID, v.File, nil)
+		}
+	}
+}
+
+// abandonResumed cancels unfinished work writing into the library that was
+// resumed from the work journal, along with the work it depends on, and
+// removes what it wrote. Nobody awaits it anymore, so the videos would never
+// get their meta and show up in the library.
+func (l *Librarian) abandonResumed() {
+	for _, ws := range overlord.GetAllWorkStatus() {
+		target := ws.Parameters["target"]
+		if ws.Done || target == "" || filepath.Dir(target) != l.dataDir {
+			continue
+		}
+		glog.Warningf("Abandoning resumed work %d writing %s.", ws.UID, target)
+		for _, uid := range append(ws.Depends, ws.UID) {
+			// Fails for work that is done already, which is fine.
+			overlord.Cancel(uid)
+		}
+		os.Remove(target)
+	}
+}
+
+func (l *Librarian) AcquireAndPlay(ctx context.Context, uri string, priority work.Priority, c Callback) ([]int64, error) {
 	metaBytes, meta, err := getWebMeta(uri)
 	if err != nil {
 		return []int64{}, errors.New(fmt.Sprintf("Invalid URI (%s: %v).", uri, err))
 	}
 	id := meta.ID
 	glog.Info("Getting video %s...", id)
-	metaFile := fmt.Sprintf("%s/%s.json", kVideoMetaDir, id)
-	dataFile := fmt.Sprintf("%s/%s.webm", kVideoDataDir, id)
+	metaFile := fmt.Sprintf("%s/%s.json", l.metaDir, id)
+	dataFile := fmt.Sprintf("%s/%s.webm", l.dataDir, id)
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if uids, ok := l.join(id, priority, c); ok {
+		return uids, nil
+	}
 	_, err = os.Stat(metaFile)
 
 	if err != nil {
 		glog.Infof("Video %s not present, downloading.", uri)
-		uids, err := overlord.WebDownload(ctx, uri, dataFile)
+		renditions := overlord.Renditions(dataFile)
+		loudnessFile := ""
+		if normalizeLoudness {
+			loudnessFile = fmt.Sprintf("%s/%s.loudness.json", l.dataDir, id)
+		}
+		uids, err := overlord.WebDownload(ctx, uri, renditions, loudnessFile, priority)
 		if err != nil {
 			return []int64{}, err
 		}
-		// Wait for the video to start being converted, then save meta and
-		// trigger callback.
-		go func(title string, path string) {
-			for {
-				stat, err := os.Stat(path)
-				if err != nil {
-					continue
-				}
-				if stat.Size() < 1024*1024 {
-					continue
-				}
-				ioutil.WriteFile(metaFile, metaBytes, 0644)
-				go c(title, path)
-				break
-			}
-		}(meta.FullTitle, dataFile)
+		l.inFlight[id] = &acquisition{uids: uids, callbacks: []Callback{c}}
+		// Start playing once there is a bit of the video to play.
+		convertUID, renditionFile := playerRendition(uids, renditions)
+		go l.await(id, uids, convertUID, kPlayableSize, meta.FullTitle, metaFile, dataFile, renditionFile, loudnessFile, metaBytes)
+		l.thumbnail(ctx, id, dataFile, uids)
 		return uids, nil
 	} else {
 		glog.Infof("Video %s present.", uri)
@@ -103,19 +394,71 @@ func (l *Librarian) AcquireAndPlay(ctx context.Context, uri string, c Callback)
 		if err != nil {
 			return []int64{}, err
 		}
-		go c(meta.FullTitle, dataFile)
+		if l.thumbnailURL(id, ".png") == "" {
+			// Videos acquired before there were thumbnails.
+			l.thumbnail(ctx, id, dataFile, nil)
+		}
+		go c(meta.FullTitle, dataFile, nil)
+		return []int64{}, nil
+	}
+}
+
+// AcquireAndPlayImage converts a still or animated image into a video showing
+// it for the given duration, and triggers the callback once it is ready.
+func (l *Librarian) AcquireAndPlayImage(ctx context.Context, uri string, duration time.Duration, priority work.Priority, c Callback) ([]int64, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return []int64{}, errors.New(fmt.Sprintf("Invalid URI (%s: %v).", uri, err))
+	}
+	sum := sha1.Sum([]byte(uri))
+	id := fmt.Sprintf("image-%s-%d", hex.EncodeToString(sum[:8]), int64(duration.Seconds()))
+	title := path.Base(u.Path)
+	if title == "." || title == "/" {
+		title = u.Host
+	}
+	metaFile := fmt.Sprintf("%s/%s.json", l.metaDir, id)
+	dataFile := fmt.Sprintf("%s/%s.webm", l.dataDir, id)
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if uids, ok := l.join(id, priority, c); ok {
+		return uids, nil
+	}
+	if _, err := os.Stat(metaFile); err == nil {
+		glog.Infof("Image %s present.", uri)
+		if l.thumbnailURL(id, ".png") == "" {
+			l.thumbnail(ctx, id, dataFile, nil)
+		}
+		go c(title, dataFile, nil)
 		return []int64{}, nil
 	}
+
+	glog.Infof("Image %s not present, downloading.", uri)
+	metaBytes, err := json.Marshal(&WebMeta{FullTitle: title, ID: id})
+	if err != nil {
+		return []int64{}, err
+	}
+	renditions := overlord.Renditions(dataFile)
+	uids, err := overlord.ImageDownload(ctx, uri, renditions, duration, priority)
+	if err != nil {
+		return []int64{}, err
+	}
+	l.inFlight[id] = &acquisition{uids: uids, callbacks: []Callback{c}}
+	// Converted images are small, so wait for the conversion to finish.
+	convertUID, renditionFile := playerRendition(uids, renditions)
+	go l.await(id, uids, convertUID, 0, title, metaFile, dataFile, renditionFile, "", metaBytes)
+	l.thumbnail(ctx, id, dataFile, uids)
+	return uids, nil
 }
 
 func (l *Librarian) GetVideos(ctx context.Context) ([]LibraryEntry, error) {
-	flist, err := ioutil.ReadDir(kVideoMetaDir)
+	flist, err := ioutil.ReadDir(l.metaDir)
 	if err != nil {
 		return nil, err
 	}
 	metaList := []LibraryEntry{}
 	for _, info := range flist {
-		metaName := fmt.Sprintf("%s/%s", kVideoMetaDir, info.Name())
+		metaName := fmt.Sprintf("%s/%s", l.metaDir, info.Name())
 		data, err := ioutil.ReadFile(metaName)
 		if err != nil {
 			return nil, err
@@ -125,12 +468,22 @@ func (l *Librarian) GetVideos(ctx context.Context) ([]LibraryEntry, error) {
 		if err != nil {
 			return nil, err
 		}
-		dataName := fmt.Sprintf("%s/%s.webm", kVideoDataDir, ytMeta.ID)
+		dataName := fmt.Sprintf("%s/%s.webm", l.dataDir, ytMeta.ID)
 		meta := LibraryEntry{
-			Title: ytMeta.FullTitle,
-			File:  dataName,
-			ID:    ytMeta.ID,
+			Title:     ytMeta.FullTitle,
+			File:      dataName,
+			ID:        ytMeta.ID,
+			Profiles:  []string{},
+			Loudness:  ytMeta.Loudness,
+			Thumbnail: l.thumbnailURL(ytMeta.ID, ".png"),
+			Preview:   l.thumbnailURL(ytMeta.ID, ".gif"),
+		}
+		for profile := range overlord.Profiles {
+			if _, err := os.Stat(work.RenditionFile(dataName, profile)); err == nil {
+				meta.Profiles = append(meta.Profiles, profile)
+			}
 		}
+		sort.Strings(meta.Profiles)
 		metaList = append(metaList, meta)
 	}
 	return metaList, nil
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/q3k/webled/work"
+)
+
+func newTestLibrarian(t *testing.T) (*Librarian, string) {
+	overlord = work.NewOverlord()
+	root := t.TempDir()
+	l := NewLibrarian(root)
+	if err := l.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return l, root
+}
+
+func TestLibrarianStart(t *testing.T) {
+	l, root := newTestLibrarian(t)
+	for _, dir := range []string{kVideoMetaDir, kVideoDataDir, kVideoThumbDir} {
+		if info, err := os.Stat(filepath.Join(root, dir)); err != nil || !info.IsDir() {
+			t.Fatalf("%s not created: %v", dir, err)
+		}
+	}
+	// Starting on an existing library is fine.
+	if err := l.Start(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLibrarianStartFails(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "file")
+	if err := ioutil.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewLibrarian(file).Start(); err == nil {
+		t.Fatal("Started with a file as library root.")
+	}
+}
+
+func TestLibrarianGetVideos(t *testing.T) {
+	l, root := newTestLibrarian(t)
+	videos, err := l.GetVideos(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(videos) != 0 {
+		t.Fatalf("Empty library has videos: %+v", videos)
+	}
+
+	meta := `{"fulltitle": "Test video", "id": "abc", "webled_loudness": {"integrated": -20}}`
+	files := map[string]string{
+		filepath.Join(root, kVideoMetaDir, "abc.json"): meta,
+		filepath.Join(root, kVideoDataDir, "abc.webm"): "",
+		filepath.Join(root, kVideoThumbDir, "abc.png"): "",
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(name, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	videos, err = l.GetVideos(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(videos) != 1 {
+		t.Fatalf("Expected one video, got %+v", videos)
+	}
+	v := videos[0]
+	if v.ID != "abc" || v.Title != "Test video" || v.File != filepath.Join(root, kVideoDataDir, "abc.webm") {
+		t.Fatalf("Unexpected video %+v", v)
+	}
+	if len(v.Profiles) != 1 || v.Profiles[0] != work.DefaultProfile {
+		t.Fatalf("Unexpected profiles %v", v.Profiles)
+	}
+	if v.Loudness == nil || v.Loudness.Integrated != -20 {
+		t.Fatalf("Unexpected loudness %+v", v.Loudness)
+	}
+	if v.Thumbnail != kThumbnailPath+"abc.png" || v.Preview != "" {
+		t.Fatalf("Unexpected thumbnail %q and preview %q", v.Thumbnail, v.Preview)
+	}
+}
+
+func TestLibrarianAbandonsResumedWork(t *testing.T) {
+	overlord = work.NewOverlord()
+	root := t.TempDir()
+	target := filepath.Join(root, kVideoDataDir, "abc.webm")
+	dl := overlord.NewRequest(context.Background(), "web_download", work.Params{"target": "/tmp/source"})
+	convert := overlord.NewRequest(context.Background(), "convert", work.Params{"source": "/tmp/source", "target": target})
+	convert.Depends = []*work.WorkRequest{dl}
+	other := overlord.NewRequest(context.Background(), "remove_file", work.Params{"path": "/tmp/other"})
+	if err := overlord.Submit(dl, convert, other); err != nil {
+		t.Fatal(err)
+	}
+
+	l := NewLibrarian(root)
+	if err := os.MkdirAll(l.dataDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(target, []byte("partial"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Start(); err != nil {
+		t.Fatal(err)
+	}
+	for _, ws := range overlord.GetWorkStatus([]int64{dl.UID, convert.UID, other.UID}) {
+		if cancelled := ws.UID != other.UID; ws.Cancelled != cancelled {
+			t.Errorf("Work %s cancelled: %v, expected %v", ws.Type, ws.Cancelled, cancelled)
+		}
+	}
+	if _, err := os.Stat(target); !os.IsNotExist(err) {
+		t.Errorf("Partial target not removed: %v", err)
+	}
+}
+
+func TestLibrarianThumbnailOnce(t *testing.T) {
+	l, root := newTestLibrarian(t)
+	overlord.Profiles["big"] = work.Profile{Width: 256, Height: 256}
+	overlord.Profiles["missing"] = work.Profile{Width: 512, Height: 512}
+	dataFile := filepath.Join(root, kVideoDataDir, "abc.webm")
+	big := work.RenditionFile(dataFile, "big")
+	for _, name := range []string{dataFile, big} {
+		if err := ioutil.WriteFile(name, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l.thumbnail(context.Background(), "abc", dataFile, nil)
+	l.thumbnail(context.Background(), "abc", dataFile, nil)
+	ws := overlord.GetAllWorkStatus()
+	if len(ws) != 1 {
+		t.Fatalf("Expected one thumbnail job, got %+v", ws)
+	}
+	if ws[0].Type != "thumbnail" || ws[0].Parameters["source"] != big {
+		t.Fatalf("Thumbnail not made from the largest rendition: %+v", ws[0])
+	}
+}
+
+func TestLibrarianBackfillsThumbnails(t *testing.T) {
+	overlord = work.NewOverlord()
+	root := t.TempDir()
+	l := NewLibrarian(root)
+	for _, dir := range []string{l.metaDir, l.dataDir, l.thumbDir} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dataFile := filepath.Join(l.dataDir, "abc.webm")
+	files := map[string]string{
+		filepath.Join(l.metaDir, "abc.json"): `{"fulltitle": "Old video", "id": "abc"}`,
+		dataFile:                             "",
+		filepath.Join(l.metaDir, "def.json"): `{"fulltitle": "Thumbnailed video", "id": "def"}`,
+		filepath.Join(l.dataDir, "def.webm"): "",
+		filepath.Join(l.thumbDir, "def.png"): "",
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(name, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.Start(); err != nil {
+		t.Fatal(err)
+	}
+	ws := overlord.GetAllWorkStatus()
+	if len(ws) != 1 || ws[0].Type != "thumbnail" || ws[0].Parameters["source"] != dataFile {
+		t.Fatalf("Expected a thumbnail of the old video only, got %+v", ws)
+	}
+}
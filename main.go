@@ -3,9 +3,14 @@ package main
 import (
 	"errors"
 	"flag"
+	"fmt"
 	"html/template"
 	"net/http"
+	"net/url"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/golang/glog"
 	"golang.org/x/net/context"
@@ -15,20 +20,48 @@ import (
 	"github.com/q3k/webled/work"
 )
 
+const (
+	kDefaultImageDuration = 10 * time.Second
+	kEffectPrefix         = "effect:"
+	// Color of errors shown on the matrix.
+	kErrorColor = 0xff0000
+)
+
+// Effects known to the remote, offered on the status page.
+var effects = []string{"plasma", "fire", "life", "starfield", "clock"}
+
 var (
-	bindAddress   string
-	remoteAddress string
-	overlord      work.Overlord
-	player        *play.Player
-	librarian     Librarian
+	bindAddress       string
+	remoteAddress     string
+	visualizer        string
+	journalDir        string
+	journalRetention  time.Duration
+	workTimeouts      string
+	workers           int
+	poolWorkers       string
+	workLimits        work.Limits
+	workMemoryLimit   uint64
+	remoteOptions     play.RemoteOptions
+	remoteProfile     string
+	profilesFile      string
+	smartCrop         bool
+	normalizeLoudness bool
+	thumbnailPreviews bool
+	overlord          *work.Overlord
+	player            *play.Player
+	libraryRoot       string
+	librarian         *Librarian
 )
 
 type pageStatus struct {
 	NowPlaying *play.VideoMeta
 	Overlord   *work.Overlord
 	Workers    []work.Worker
+	Work       []*work.WorkStatus
 	Playlist   []play.VideoMeta
 	Library    []LibraryEntry
+	Cache      *play.CacheStatus
+	Effects    []string
 }
 
 func handleStatus(w http.ResponseWriter, r *http.Request) {
@@ -45,12 +78,19 @@ func handleStatus(w http.ResponseWriter, r *http.Request) {
 		glog.Error(err)
 		return
 	}
+	cache, err := player.GetCache(ctx)
+	if err != nil {
+		glog.Warningf("Could not get remote cache status: %v", err)
+	}
 	p := pageStatus{
-		Overlord:   &overlord,
+		Overlord:   overlord,
 		Workers:    overlord.GetWorkers(),
+		Work:       overlord.GetAllWorkStatus(),
 		Playlist:   player.GetPlaylist(),
 		Library:    videos,
 		NowPlaying: player.Now(),
+		Cache:      cache,
+		Effects:    effects,
 	}
 	t.Execute(w, p)
 }
@@ -63,14 +103,82 @@ type APILibrary struct {
 	Videos []LibraryEntry `json:"videos"`
 }
 
-func apiPlay(ctx context.Context, r *http.Request, c func(string, string)) ([]int64, error) {
+type APIWorkLog struct {
+	UID    int64          `json:"uid"`
+	Error  *work.JobError `json:"error"`
+	Output string         `json:"output"`
+}
+
+// parseKeyValues parses flags of the form key=value,key=value.
+func parseKeyValues(s string) (map[string]string, error) {
+	res := make(map[string]string)
+	for _, kv := range strings.Split(s, ",") {
+		if kv == "" {
+			continue
+		}
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Expected key=value, got %q.", kv)
+		}
+		res[parts[0]] = parts[1]
+	}
+	return res, nil
+}
+
+// playCallback passes acquired videos to playFunc, and shows why on the
+// matrix if they could not be acquired.
+func playCallback(playFunc func(string, string)) Callback {
+	return func(title, file string, err error) {
+		if err != nil {
+			glog.Errorf("Could not acquire %s: %v", title, err)
+			player.ShowText(play.TextMessage{
+				Text:   fmt.Sprintf("Could not play %s: %v", title, err),
+				Color:  kErrorColor,
+				Scroll: true,
+			})
+			return
+		}
+		playFunc(title, file)
+	}
+}
+
+// apiPlay acquires what was asked for and passes it to c once it is ready.
+// Any work needed is done at the given priority, unless the caller asks for
+// another one.
+func apiPlay(ctx context.Context, r *http.Request, c Callback, priority work.Priority) ([]int64, error) {
+	if s := r.URL.Query().Get("priority"); s != "" {
+		p, err := work.ParsePriority(s)
+		if err != nil {
+			return []int64{}, err
+		}
+		priority = p
+	}
 	uri := r.URL.Query().Get("uri")
 	id := r.URL.Query().Get("id")
-	if uri == "" && id == "" {
-		return []int64{}, errors.New("No uri or id provided.")
+	image := r.URL.Query().Get("image")
+	if uri == "" && id == "" && image == "" {
+		return []int64{}, errors.New("No uri, id or image provided.")
 	}
-	if uri != "" {
-		uids, err := librarian.AcquireAndPlay(ctx, uri, c)
+	if strings.HasPrefix(uri, kEffectPrefix) {
+		// Effects are generated by the remote, nothing to acquire.
+		u, err := url.Parse(uri)
+		if err != nil || u.Opaque == "" {
+			return []int64{}, errors.New("Invalid effect.")
+		}
+		c(u.Opaque, uri, nil)
+		return []int64{}, nil
+	} else if image != "" {
+		duration := kDefaultImageDuration
+		if s := r.URL.Query().Get("duration"); s != "" {
+			seconds, err := strconv.ParseFloat(s, 64)
+			if err != nil || seconds <= 0 {
+				return []int64{}, errors.New("Invalid duration.")
+			}
+			duration = time.Duration(seconds * float64(time.Second))
+		}
+		return librarian.AcquireAndPlayImage(ctx, image, duration, priority, c)
+	} else if uri != "" {
+		uids, err := librarian.AcquireAndPlay(ctx, uri, priority, c)
 		if err != nil {
 			return []int64{}, err
 		}
@@ -82,7 +190,7 @@ func apiPlay(ctx context.Context, r *http.Request, c func(string, string)) ([]in
 		}
 		for _, video := range videos {
 			if video.ID == id {
-				c(video.Title, video.File)
+				c(video.Title, video.File, nil)
 				return []int64{}, nil
 			}
 		}
@@ -90,29 +198,182 @@ func apiPlay(ctx context.Context, r *http.Request, c func(string, string)) ([]in
 	}
 }
 
+// parseColor parses an RRGGBB hex color, optionally prefixed with #.
+func parseColor(s string) (uint32, error) {
+	c, err := strconv.ParseUint(strings.TrimPrefix(s, "#"), 16, 32)
+	if err != nil || c > 0xffffff {
+		return 0, errors.New("Invalid color.")
+	}
+	return uint32(c), nil
+}
+
+func apiShowText(ctx context.Context, r *http.Request) (interface{}, error) {
+	q := r.URL.Query()
+	m := play.TextMessage{
+		Text: q.Get("text"),
+	}
+	if m.Text == "" {
+		return nil, errors.New("No text provided.")
+	}
+	if s := q.Get("color"); s != "" {
+		c, err := parseColor(s)
+		if err != nil {
+			return nil, err
+		}
+		m.Color = c
+	}
+	if s := q.Get("scroll"); s != "" {
+		scroll, err := strconv.ParseBool(s)
+		if err != nil {
+			return nil, errors.New("Invalid scroll flag.")
+		}
+		m.Scroll = scroll
+	}
+	if s := q.Get("duration"); s != "" {
+		seconds, err := strconv.ParseFloat(s, 64)
+		if err != nil || seconds < 0 {
+			return nil, errors.New("Invalid duration.")
+		}
+		m.Duration = time.Duration(seconds * float64(time.Second))
+	}
+	if s := q.Get("scale"); s != "" {
+		scale, err := strconv.Atoi(s)
+		if err != nil || scale < 1 {
+			return nil, errors.New("Invalid scale.")
+		}
+		m.Scale = scale
+	}
+	player.ShowText(m)
+	return nil, nil
+}
+
+// apiSetOverlay updates the parts of the overlay given in the request, keeping
+// the rest as it was.
+func apiSetOverlay(ctx context.Context, r *http.Request) (interface{}, error) {
+	q := r.URL.Query()
+	o := player.GetOverlay()
+	for name, flag := range map[string]*bool{"clock": &o.Clock, "title": &o.Title} {
+		if s := q.Get(name); s != "" {
+			v, err := strconv.ParseBool(s)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid %s flag.", name)
+			}
+			*flag = v
+		}
+	}
+	if _, ok := q["badge"]; ok {
+		o.Badge = q.Get("badge")
+	}
+	for name, c := range map[string]*uint32{"color": &o.Color, "badge_color": &o.BadgeColor} {
+		if s := q.Get(name); s != "" {
+			v, err := parseColor(s)
+			if err != nil {
+				return nil, err
+			}
+			*c = v
+		}
+	}
+	if err := player.SetOverlay(ctx, o); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
 func main() {
 	flag.StringVar(&remoteAddress, "remote_address", "127.0.0.1:8080", "Address of the remote GRPC endpoint.")
+	flag.StringVar(&remoteOptions.CAFile, "remote_ca", "", "CA bundle to verify the remote against. Enables TLS.")
+	flag.StringVar(&remoteOptions.CertFile, "remote_cert", "", "Client certificate to present to the remote. Requires -remote_ca and -remote_key.")
+	flag.StringVar(&remoteOptions.KeyFile, "remote_key", "", "Private key for the client certificate.")
+	flag.StringVar(&remoteOptions.ServerName, "remote_server_name", "", "Name expected in the remote's certificate, if different from its address.")
+	flag.StringVar(&remoteOptions.TokenFile, "remote_token_file", "", "File containing the bearer token for the remote.")
+	flag.StringVar(&remoteProfile, "remote_profile", work.DefaultProfile, "Conversion profile matching the remote's display.")
 	flag.StringVar(&bindAddress, "bind_address", ":8081", "Address to bind web interface to.")
+	flag.StringVar(&libraryRoot, "library_root", "/var/webled", "Directory to keep the library of converted videos in.")
+	flag.StringVar(&journalDir, "journal_dir", "", "Directory to journal work to, so that it survives restarts. Defaults to journal in the library root.")
+	flag.DurationVar(&journalRetention, "journal_retention", 7*24*time.Hour, "How long to keep records of finished work.")
+	flag.IntVar(&workers, "workers", 4, "Number of workers running jobs that have no pool of their own.")
+	flag.StringVar(&poolWorkers, "pool_workers", "", "Comma separated sizes of pools of workers dedicated to a job type, eg. web_download=4,convert=1.")
+	flag.StringVar(&workTimeouts, "work_timeouts", "", "Comma separated job type timeouts overriding the defaults, eg. web_download=1h,convert=3h.")
+	flag.IntVar(&workLimits.Nice, "work_nice", 0, "CPU niceness of commands run by jobs, 0 to leave unchanged (Linux only, runs them through nice(1)).")
+	flag.IntVar(&workLimits.IOClass, "work_ionice_class", 0, "I/O scheduling class of commands run by jobs (Linux only, runs them through ionice(1) from util-linux; 0 to leave unchanged, 1 realtime, 2 best-effort, 3 idle, which can starve jobs on a busy disk).")
+	flag.IntVar(&workLimits.IOPriority, "work_ionice_priority", 0, "I/O priority within the scheduling class, 0 to 7.")
+	flag.Uint64Var(&workMemoryLimit, "work_memory_limit", 0, "Address space limit for commands run by jobs in MiB, 0 for none (Linux only, runs them through prlimit(1) from util-linux, which must be installed).")
+	flag.StringVar(&visualizer, "visualizer", "spectrum", "Visualization rendered for audio-only sources (spectrum or waveform).")
+	flag.BoolVar(&thumbnailPreviews, "thumbnail_previews", true, "Make short animated previews of videos along with their thumbnails.")
+	flag.BoolVar(&normalizeLoudness, "normalize_loudness", true, "Measure the loudness of videos and normalize their audio to a consistent level.")
+	flag.BoolVar(&smartCrop, "smart_crop", false, "Analyze videos to crop them around the action rather than at the center, for profiles that crop.")
+	flag.StringVar(&profilesFile, "profiles", "", "JSON file of conversion profiles by name, each with width, height, mode (crop, fit or letterbox), video_codec, video_bitrate, fps, audio and audio_codec. Every video is converted with each of them.")
 	flag.Parse()
 	glog.Info("Starting webled...")
 
+	if !work.IsVisualizer(visualizer) {
+		glog.Exitf("Unknown visualizer %q.", visualizer)
+	}
 	overlord = work.NewOverlord()
-	overlord.SpawnWorker()
-	overlord.SpawnWorker()
-	overlord.SpawnWorker()
-	overlord.SpawnWorker()
+	overlord.Visualizer = visualizer
+	overlord.JournalRetention = journalRetention
+	if profilesFile != "" {
+		profiles, err := work.LoadProfiles(profilesFile)
+		if err != nil {
+			glog.Exitf("Could not load profiles: %v", err)
+		}
+		overlord.Profiles = profiles
+	}
+	overlord.SmartCrop = smartCrop
+	if _, ok := overlord.Profiles[remoteProfile]; !ok {
+		glog.Exitf("Unknown -remote_profile %q.", remoteProfile)
+	}
+	timeouts, err := parseKeyValues(workTimeouts)
+	if err != nil {
+		glog.Exitf("Invalid -work_timeouts: %v", err)
+	}
+	for t, s := range timeouts {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			glog.Exitf("Invalid timeout for %s: %v", t, err)
+		}
+		overlord.Timeouts[t] = d
+	}
+	workLimits.Memory = workMemoryLimit * 1024 * 1024
+	overlord.Limits = workLimits
+	if journalDir == "" {
+		journalDir = filepath.Join(libraryRoot, "journal")
+	}
+	if err := overlord.OpenJournal(journalDir); err != nil {
+		glog.Exitf("Could not open work journal: %v", err)
+	}
+	if err := overlord.Resize("default", workers); err != nil {
+		glog.Exit(err)
+	}
+	pools, err := parseKeyValues(poolWorkers)
+	if err != nil {
+		glog.Exitf("Invalid -pool_workers: %v", err)
+	}
+	for t, s := range pools {
+		size, err := strconv.Atoi(s)
+		if err != nil {
+			glog.Exitf("Invalid pool size for %s: %v", t, err)
+		}
+		if err := overlord.Resize(t, size); err != nil {
+			glog.Exit(err)
+		}
+	}
+	// Before dispatching, so that work resumed for the library is abandoned
+	// before it runs.
+	librarian = NewLibrarian(libraryRoot)
+	if err := librarian.Start(); err != nil {
+		glog.Exitf("Could not start librarian: %v", err)
+	}
 	overlord.StartDispatching()
 
-	librarian.Start()
-
-	var err error
-	player, err = play.NewPlayer(remoteAddress)
+	player, err = play.NewPlayer(remoteAddress, remoteProfile, remoteOptions)
 	if err != nil {
 		glog.Exit(err)
 	}
 	player.StartPlaylist()
 
 	http.HandleFunc("/", handleStatus)
+	http.Handle(kThumbnailPath, http.StripPrefix(kThumbnailPath, http.FileServer(http.Dir(librarian.thumbDir))))
 
 	handleAPI("webled/library/get", func(ctx context.Context, r *http.Request) (interface{}, error) {
 		videos, err := librarian.GetVideos(ctx)
@@ -130,11 +391,11 @@ func main() {
 	})
 
 	handleAPI("webled/playlist/play/now", func(ctx context.Context, r *http.Request) (interface{}, error) {
-		return apiPlay(ctx, r, player.PlayNow)
+		return apiPlay(ctx, r, playCallback(player.PlayNow), work.PRIORITY_INTERACTIVE)
 	})
 
 	handleAPI("webled/playlist/play/append", func(ctx context.Context, r *http.Request) (interface{}, error) {
-		return apiPlay(ctx, r, player.PlayAppend)
+		return apiPlay(ctx, r, playCallback(player.PlayAppend), work.PRIORITY_NORMAL)
 	})
 
 	handleAPI("webled/playlist/stop", func(ctx context.Context, r *http.Request) (interface{}, error) {
@@ -142,6 +403,26 @@ func main() {
 		return nil, nil
 	})
 
+	handleAPI("webled/text/show", apiShowText)
+
+	handleAPI("webled/overlay/get", func(ctx context.Context, r *http.Request) (interface{}, error) {
+		return player.GetOverlay(), nil
+	})
+
+	handleAPI("webled/overlay/set", apiSetOverlay)
+
+	handleAPI("webled/cache/get", func(ctx context.Context, r *http.Request) (interface{}, error) {
+		return player.GetCache(ctx)
+	})
+
+	handleAPI("webled/cache/evict", func(ctx context.Context, r *http.Request) (interface{}, error) {
+		name := r.URL.Query().Get("name")
+		if name == "" {
+			return nil, errors.New("No name provided.")
+		}
+		return nil, player.Evict(ctx, name)
+	})
+
 	handleAPI("webled/work/get", func(ctx context.Context, r *http.Request) (interface{}, error) {
 		uidsString := r.URL.Query()["uid"]
 		uidsInt := []int64{}
@@ -155,6 +436,45 @@ func main() {
 		return overlord.GetWorkStatus(uidsInt), nil
 	})
 
+	handleAPI("webled/work/cancel", func(ctx context.Context, r *http.Request) (interface{}, error) {
+		uid, err := strconv.ParseInt(r.URL.Query().Get("uid"), 10, 64)
+		if err != nil {
+			return nil, errors.New("Invalid uid.")
+		}
+		return nil, overlord.Cancel(uid)
+	})
+
+	handleAPI("webled/work/log", func(ctx context.Context, r *http.Request) (interface{}, error) {
+		uid, err := strconv.ParseInt(r.URL.Query().Get("uid"), 10, 64)
+		if err != nil {
+			return nil, errors.New("Invalid uid.")
+		}
+		ws := overlord.GetWorkStatus([]int64{uid})
+		if len(ws) != 1 {
+			return nil, fmt.Errorf("No such work %d.", uid)
+		}
+		output, err := overlord.GetWorkOutput(uid)
+		if err != nil {
+			return nil, err
+		}
+		return APIWorkLog{UID: uid, Error: ws[0].LastError, Output: output}, nil
+	})
+
+	handleAPI("webled/work/pools/get", func(ctx context.Context, r *http.Request) (interface{}, error) {
+		return overlord.GetPools(), nil
+	})
+
+	handleAPI("webled/work/pools/resize", func(ctx context.Context, r *http.Request) (interface{}, error) {
+		size, err := strconv.Atoi(r.URL.Query().Get("size"))
+		if err != nil {
+			return nil, errors.New("Invalid size.")
+		}
+		if err := overlord.Resize(r.URL.Query().Get("pool"), size); err != nil {
+			return nil, err
+		}
+		return overlord.GetPools(), nil
+	})
+
 	http.HandleFunc("/requests", func(w http.ResponseWriter, r *http.Request) {
 		trace.Render(w, r, true)
 	})
@@ -0,0 +1,106 @@
+package play
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+
+	pb "github.com/q3k/webled/proto"
+)
+
+const (
+	kUploadChunkSize = 64 * 1024
+)
+
+// For JSON API
+type CacheEntry struct {
+	Name     string    `json:"name"`
+	SHA256   string    `json:"sha256"`
+	Size     int64     `json:"size"`
+	LastUsed time.Time `json:"last_used"`
+}
+
+type CacheStatus struct {
+	Entries []CacheEntry `json:"entries"`
+	Size    int64        `json:"size"`
+	Limit   int64        `json:"limit"`
+}
+
+// Upload sends a local file to the remote's cache.
+func (p *Player) Upload(ctx context.Context, file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		return err
+	}
+
+	stream, err := p.client.PutFile(ctx)
+	if err != nil {
+		return err
+	}
+	chunk := &pb.PutFileChunk{
+		Name:   file,
+		Sha256: hex.EncodeToString(h.Sum(nil)),
+	}
+	buf := make([]byte, kUploadChunkSize)
+	for {
+		n, err := f.Read(buf)
+		if n > 0 {
+			chunk.Data = buf[:n]
+			if err := stream.Send(chunk); err != nil {
+				return err
+			}
+			chunk = &pb.PutFileChunk{}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	res, err := stream.CloseAndRecv()
+	if err != nil {
+		return err
+	}
+	glog.Infof("Uploaded %s to remote (%d bytes).", file, res.Entry.Size)
+	return nil
+}
+
+func (p *Player) GetCache(ctx context.Context) (*CacheStatus, error) {
+	res, err := p.client.ListCache(ctx, &pb.ListCacheRequest{})
+	if err != nil {
+		return nil, err
+	}
+	s := &CacheStatus{
+		Entries: []CacheEntry{},
+		Size:    res.Size,
+		Limit:   res.Limit,
+	}
+	for _, e := range res.Entries {
+		s.Entries = append(s.Entries, CacheEntry{
+			Name:     e.Name,
+			SHA256:   e.Sha256,
+			Size:     e.Size,
+			LastUsed: time.Unix(e.LastUsed, 0),
+		})
+	}
+	return s, nil
+}
+
+func (p *Player) Evict(ctx context.Context, name string) error {
+	_, err := p.client.EvictFile(ctx, &pb.EvictFileRequest{Name: name})
+	return err
+}
@@ -0,0 +1,95 @@
+package play
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// RemoteOptions configures how the Player authenticates to the remote. The
+// zero value connects over plaintext without credentials.
+type RemoteOptions struct {
+	// CA bundle to verify the remote against. Setting this enables TLS.
+	CAFile string
+	// Client certificate and key, for remotes requiring mutual TLS. Both
+	// must be given, along with CAFile.
+	CertFile string
+	KeyFile  string
+	// Overrides the name expected in the remote's certificate.
+	ServerName string
+	// File containing the bearer token sent with every call.
+	TokenFile string
+}
+
+type tokenCredentials struct {
+	token  string
+	secure bool
+}
+
+func (t *tokenCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{
+		"authorization": "Bearer " + t.token,
+	}, nil
+}
+
+func (t *tokenCredentials) RequireTransportSecurity() bool {
+	return t.secure
+}
+
+func (o *RemoteOptions) dialOptions() ([]grpc.DialOption, error) {
+	opts := []grpc.DialOption{}
+	if (o.CertFile == "") != (o.KeyFile == "") {
+		return nil, errors.New("Client certificate and key must be given together.")
+	}
+	secure := o.CAFile != ""
+	if !secure && o.CertFile != "" {
+		return nil, errors.New("Client certificate given without a CA to enable TLS.")
+	}
+	if secure {
+		data, err := ioutil.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("No certificates found in %s.", o.CAFile)
+		}
+		config := &tls.Config{
+			RootCAs:    pool,
+			ServerName: o.ServerName,
+		}
+		if o.CertFile != "" {
+			cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+			if err != nil {
+				return nil, err
+			}
+			config.Certificates = []tls.Certificate{cert}
+		}
+		opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(config)))
+	} else {
+		opts = append(opts, grpc.WithInsecure())
+	}
+
+	if o.TokenFile != "" {
+		data, err := ioutil.ReadFile(o.TokenFile)
+		if err != nil {
+			return nil, err
+		}
+		token := strings.TrimSpace(string(data))
+		if token == "" {
+			return nil, fmt.Errorf("Token file %s is empty.", o.TokenFile)
+		}
+		opts = append(opts, grpc.WithPerRPCCredentials(&tokenCredentials{
+			token:  token,
+			secure: secure,
+		}))
+	}
+	return opts, nil
+}
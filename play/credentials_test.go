@@ -0,0 +1,20 @@
+package play
+
+import "testing"
+
+func TestDialOptionsRejectsPartialTLS(t *testing.T) {
+	for _, o := range []RemoteOptions{
+		{CertFile: "client.pem", KeyFile: "client.key"},
+		{CAFile: "ca.pem", CertFile: "client.pem"},
+		{CAFile: "ca.pem", KeyFile: "client.key"},
+		{KeyFile: "client.key"},
+	} {
+		if _, err := o.dialOptions(); err == nil {
+			t.Errorf("Accepted %+v", o)
+		}
+	}
+	o := RemoteOptions{}
+	if _, err := o.dialOptions(); err != nil {
+		t.Errorf("Plaintext rejected: %v", err)
+	}
+}
@@ -2,13 +2,17 @@ package play
 
 import (
 	"container/list"
+	"os"
 	"sync"
+	"time"
 
 	"github.com/golang/glog"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 
 	pb "github.com/q3k/webled/proto"
+	"github.com/q3k/webled/work"
 )
 
 type VideoMeta struct {
@@ -16,6 +20,30 @@ type VideoMeta struct {
 	File  string
 }
 
+// TextMessage is shown on the display in place of whatever is playing, which
+// resumes afterwards.
+type TextMessage struct {
+	Text string
+	// 0xRRGGBB, white if zero.
+	Color  uint32
+	Scroll bool
+	// Zero for the remote's default.
+	Duration time.Duration
+	Scale    int
+}
+
+// Overlay configures what the remote composites on top of everything it
+// plays.
+type Overlay struct {
+	Clock bool   `json:"clock"`
+	Title bool   `json:"title"`
+	Badge string `json:"badge"`
+	// 0xRRGGBB, white if zero.
+	Color uint32 `json:"color"`
+	// 0xRRGGBB, red if zero.
+	BadgeColor uint32 `json:"badge_color"`
+}
+
 type PlaylistCommand struct {
 	command int
 	title   string
@@ -33,7 +61,18 @@ const (
 )
 
 type Player struct {
-	client   pb.RemoteVideoClient
+	client pb.RemoteVideoClient
+	// Conversion profile matching the display, see work.Profile.
+	profile string
+	overlay struct {
+		mutex  sync.RWMutex
+		config Overlay
+	}
+	// Files still being produced, each with a channel closed once complete.
+	growing struct {
+		mutex sync.Mutex
+		files map[string]chan bool
+	}
 	playlist struct {
 		events   chan bool
 		curate   bool
@@ -44,14 +83,20 @@ type Player struct {
 	}
 }
 
-func NewPlayer(remote string) (*Player, error) {
-	conn, err := grpc.Dial(remote, grpc.WithInsecure())
+func NewPlayer(remote string, profile string, options RemoteOptions) (*Player, error) {
+	opts, err := options.dialOptions()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := grpc.Dial(remote, opts...)
 	if err != nil {
 		return nil, err
 	}
 	p := &Player{
-		client: pb.NewRemoteVideoClient(conn),
+		client:  pb.NewRemoteVideoClient(conn),
+		profile: profile,
 	}
+	p.growing.files = make(map[string]chan bool)
 	p.playlist.events = make(chan bool, 100)
 	p.playlist.videos = list.New()
 	p.playlist.commands = make(chan PlaylistCommand, 100)
@@ -73,6 +118,25 @@ func (p *Player) Now() *VideoMeta {
 	return &meta
 }
 
+// Profile returns the name of the conversion profile matching the display.
+func (p *Player) Profile() string {
+	return p.profile
+}
+
+// rendition returns the rendition of a library file to play, falling back to
+// the default one if there is none for the Player's profile.
+func (p *Player) rendition(file string) string {
+	r := work.RenditionFile(file, p.profile)
+	if r == file {
+		return file
+	}
+	if _, err := os.Stat(r); err != nil {
+		glog.Warningf("No %s rendition of %v, playing default one.", p.profile, file)
+		return file
+	}
+	return r
+}
+
 func (p *Player) curator() {
 	for {
 		<-p.playlist.events
@@ -92,12 +156,28 @@ func (p *Player) curator() {
 		for e := p.playlist.videos.Front(); e != nil; e = e.Next() {
 			if i == p.playlist.index {
 				meta := e.Value.(VideoMeta)
+				file := p.rendition(meta.File)
+				complete, growing := p.isGrowing(file)
 				req := &pb.PlayRequest{
-					Filename: meta.File,
+					Filename: file,
+					Title:    meta.Title,
+					Growing:  growing,
 				}
 				go func() {
-					glog.Infof("Now playing: %v (%v)", meta.Title, meta.File)
+					glog.Infof("Now playing: %v (%v)", meta.Title, file)
 					_, err := p.client.Play(context.Background(), req)
+					if grpc.Code(err) == codes.NotFound {
+						if growing {
+							// Only complete files can be uploaded.
+							glog.Infof("%v not visible to remote while growing, waiting for it...", file)
+							<-complete
+							req.Growing = false
+						}
+						glog.Infof("%v not present on remote, uploading...", file)
+						if err = p.Upload(context.Background(), file); err == nil {
+							_, err = p.client.Play(context.Background(), req)
+						}
+					}
 					if err != nil {
 						glog.Infof("Playback result: %v", err)
 						return
@@ -170,6 +250,30 @@ func (p *Player) GetPlaylist() []VideoMeta {
 	return l
 }
 
+// SetGrowing tells the Player whether a file is still being produced, eg. by
+// a conversion in progress. Growing files are followed by the remote as they
+// are written rather than uploaded to its cache.
+func (p *Player) SetGrowing(file string, growing bool) {
+	p.growing.mutex.Lock()
+	defer p.growing.mutex.Unlock()
+	complete, ok := p.growing.files[file]
+	if growing && !ok {
+		p.growing.files[file] = make(chan bool)
+	} else if !growing && ok {
+		close(complete)
+		delete(p.growing.files, file)
+	}
+}
+
+// isGrowing returns whether a file is still being produced, and if so a
+// channel closed once it is complete.
+func (p *Player) isGrowing(file string) (chan bool, bool) {
+	p.growing.mutex.Lock()
+	defer p.growing.mutex.Unlock()
+	complete, ok := p.growing.files[file]
+	return complete, ok
+}
+
 func (p *Player) PlayNow(title string, file string) {
 	c := PlaylistCommand{
 		command: PLAYLIST_NOW,
@@ -211,3 +315,42 @@ func (p *Player) Stop() {
 	}
 	p.playlist.commands <- c
 }
+
+func (p *Player) ShowText(m TextMessage) {
+	req := &pb.ShowTextRequest{
+		Text:       m.Text,
+		Color:      m.Color,
+		Scroll:     m.Scroll,
+		DurationMs: int64(m.Duration / time.Millisecond),
+		Scale:      int32(m.Scale),
+	}
+	go func() {
+		glog.Infof("Showing text: %q", m.Text)
+		if _, err := p.client.ShowText(context.Background(), req); err != nil {
+			glog.Warningf("Could not show text: %v", err)
+		}
+	}()
+}
+
+func (p *Player) GetOverlay() Overlay {
+	p.overlay.mutex.RLock()
+	defer p.overlay.mutex.RUnlock()
+	return p.overlay.config
+}
+
+func (p *Player) SetOverlay(ctx context.Context, o Overlay) error {
+	p.overlay.mutex.Lock()
+	defer p.overlay.mutex.Unlock()
+	req := &pb.SetOverlayRequest{
+		Clock:      o.Clock,
+		Title:      o.Title,
+		Badge:      o.Badge,
+		Color:      o.Color,
+		BadgeColor: o.BadgeColor,
+	}
+	if _, err := p.client.SetOverlay(ctx, req); err != nil {
+		return err
+	}
+	p.overlay.config = o
+	return nil
+}
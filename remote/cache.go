@@ -0,0 +1,283 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	kCacheIndexName = "index.json"
+)
+
+// cacheEntry describes a single file held by the remote on behalf of webled.
+// Files are stored in the cache directory under their SHA256 sum and
+// referred to by the name webled knows them under.
+type cacheEntry struct {
+	Name     string    `json:"name"`
+	SHA256   string    `json:"sha256"`
+	Size     int64     `json:"size"`
+	LastUsed time.Time `json:"last_used"`
+}
+
+type mediaCache struct {
+	dir   string
+	limit int64
+
+	mutex   sync.Mutex
+	entries map[string]*cacheEntry
+	size    int64
+}
+
+func newMediaCache(dir string, limit int64) (*mediaCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	c := &mediaCache{
+		dir:     dir,
+		limit:   limit,
+		entries: make(map[string]*cacheEntry),
+	}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *mediaCache) blobPath(sum string) string {
+	return fmt.Sprintf("%s/%s", c.dir, sum)
+}
+
+func fileChecksum(path string) (string, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
+
+// load reads the cache index and verifies every file in it, dropping entries
+// whose data is missing or corrupted, as well as any stray files.
+func (c *mediaCache) load() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	data, err := ioutil.ReadFile(fmt.Sprintf("%s/%s", c.dir, kCacheIndexName))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	entries := []*cacheEntry{}
+	if err == nil {
+		if err := json.Unmarshal(data, &entries); err != nil {
+			glog.Warningf("Cache index corrupted, starting from scratch: %v", err)
+			entries = []*cacheEntry{}
+		}
+	}
+
+	verified := make(map[string]bool)
+	for _, e := range entries {
+		if !verified[e.SHA256] {
+			sum, size, err := fileChecksum(c.blobPath(e.SHA256))
+			if err != nil || sum != e.SHA256 || size != e.Size {
+				glog.Warningf("Dropping cache entry %s: verification failed (%v).", e.Name, err)
+				continue
+			}
+			verified[e.SHA256] = true
+		}
+		c.entries[e.Name] = e
+	}
+
+	flist, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		return err
+	}
+	for _, info := range flist {
+		if info.Name() == kCacheIndexName || verified[info.Name()] {
+			continue
+		}
+		glog.Infof("Removing stray cache file %s.", info.Name())
+		os.Remove(fmt.Sprintf("%s/%s", c.dir, info.Name()))
+	}
+
+	c.recount()
+	c.evict(0)
+	return c.save()
+}
+
+// recount recomputes the total size of the cache, counting shared blobs once.
+func (c *mediaCache) recount() {
+	c.size = 0
+	seen := make(map[string]bool)
+	for _, e := range c.entries {
+		if seen[e.SHA256] {
+			continue
+		}
+		seen[e.SHA256] = true
+		c.size += e.Size
+	}
+}
+
+func (c *mediaCache) save() error {
+	entries := []*cacheEntry{}
+	for _, e := range c.entries {
+		entries = append(entries, e)
+	}
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	tmp := fmt.Sprintf("%s/%s.temporary", c.dir, kCacheIndexName)
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, fmt.Sprintf("%s/%s", c.dir, kCacheIndexName))
+}
+
+// remove drops an entry, deleting its blob if no other entry refers to it.
+func (c *mediaCache) remove(name string) {
+	e := c.entries[name]
+	if e == nil {
+		return
+	}
+	delete(c.entries, name)
+	for _, other := range c.entries {
+		if other.SHA256 == e.SHA256 {
+			return
+		}
+	}
+	os.Remove(c.blobPath(e.SHA256))
+	c.size -= e.Size
+}
+
+// evict removes least recently used entries until need more bytes fit within
+// the cache limit.
+func (c *mediaCache) evict(need int64) {
+	if c.limit <= 0 {
+		return
+	}
+	lru := []*cacheEntry{}
+	for _, e := range c.entries {
+		lru = append(lru, e)
+	}
+	sort.Slice(lru, func(i, j int) bool {
+		return lru[i].LastUsed.Before(lru[j].LastUsed)
+	})
+	for _, e := range lru {
+		if c.size+need <= c.limit {
+			return
+		}
+		glog.Infof("Evicting %s from cache.", e.Name)
+		c.remove(e.Name)
+	}
+}
+
+// Lookup returns the path of a cached file and marks it as recently used.
+func (c *mediaCache) Lookup(name string) (string, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	e := c.entries[name]
+	if e == nil {
+		return "", false
+	}
+	e.LastUsed = time.Now()
+	if err := c.save(); err != nil {
+		glog.Warningf("Could not save cache index: %v", err)
+	}
+	return c.blobPath(e.SHA256), true
+}
+
+// Put stores data read from r under name, verifying it against sum.
+func (c *mediaCache) Put(name string, sum string, r io.Reader) (*cacheEntry, error) {
+	if name == "" {
+		return nil, errors.New("No name specified.")
+	}
+	f, err := ioutil.TempFile(c.dir, "upload")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(f, h), r)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	actual := hex.EncodeToString(h.Sum(nil))
+	if sum != "" && actual != sum {
+		return nil, fmt.Errorf("Checksum mismatch (expected %s, got %s).", sum, actual)
+	}
+	if c.limit > 0 && size > c.limit {
+		return nil, fmt.Errorf("File too large for cache (%d > %d bytes).", size, c.limit)
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.remove(name)
+	shared := false
+	for _, e := range c.entries {
+		if e.SHA256 == actual {
+			shared = true
+			break
+		}
+	}
+	if !shared {
+		c.evict(size)
+		if err := os.Rename(f.Name(), c.blobPath(actual)); err != nil {
+			return nil, err
+		}
+		c.size += size
+	}
+	e := &cacheEntry{
+		Name:     name,
+		SHA256:   actual,
+		Size:     size,
+		LastUsed: time.Now(),
+	}
+	c.entries[name] = e
+	if err := c.save(); err != nil {
+		return nil, err
+	}
+	res := *e
+	return &res, nil
+}
+
+func (c *mediaCache) Evict(name string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.entries[name] == nil {
+		return fmt.Errorf("%s not in cache.", name)
+	}
+	c.remove(name)
+	return c.save()
+}
+
+// List returns all cache entries, most recently used first, and the total
+// size of the cache.
+func (c *mediaCache) List() ([]cacheEntry, int64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	res := []cacheEntry{}
+	for _, e := range c.entries {
+		res = append(res, *e)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].LastUsed.After(res[j].LastUsed)
+	})
+	return res, c.size
+}
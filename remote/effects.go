@@ -0,0 +1,331 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"math/rand"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	kEffectPrefix          = "effect:"
+	kDefaultEffectDuration = 60 * time.Second
+	// Generations per second of the Game of Life.
+	kLifeRate = 10
+	// Generations after which the Game of Life is reseeded, in case it got
+	// stuck in a loop.
+	kLifeMaxGenerations = 1000
+	kStarCount          = 200
+)
+
+// effects maps names usable in effect:NAME playlist entries to constructors.
+var effects = map[string]func(params url.Values) frameSource{
+	"plasma":    newPlasma,
+	"fire":      newFire,
+	"life":      newLife,
+	"starfield": newStarfield,
+	"clock":     newClock,
+}
+
+// timed wraps a source to make it end after a fixed duration.
+type timed struct {
+	frameSource
+	duration time.Duration
+}
+
+func (s *timed) Frame(t time.Duration, img *image.RGBA) bool {
+	if s.duration > 0 && t >= s.duration {
+		return false
+	}
+	return s.frameSource.Frame(t, img)
+}
+
+// parseEffect builds a frame source from a playlist entry like
+// effect:plasma?duration=60. A duration of 0 runs the effect until
+// interrupted.
+func parseEffect(entry string) (frameSource, error) {
+	u, err := url.Parse(entry)
+	if err != nil {
+		return nil, err
+	}
+	constructor, ok := effects[u.Opaque]
+	if !ok {
+		return nil, fmt.Errorf("Unknown effect %q.", u.Opaque)
+	}
+	params := u.Query()
+	duration := kDefaultEffectDuration
+	if s := params.Get("duration"); s != "" {
+		seconds, err := strconv.ParseFloat(s, 64)
+		if err != nil || seconds < 0 {
+			return nil, fmt.Errorf("Invalid duration %q.", s)
+		}
+		duration = time.Duration(seconds * float64(time.Second))
+	}
+	return &timed{constructor(params), duration}, nil
+}
+
+// hsv converts a hue in [0, 1) at full saturation and the given value into a
+// color.
+func hsv(h, v float64) color.RGBA {
+	h = (h - math.Floor(h)) * 6
+	x := uint8(255 * v * (1 - math.Abs(math.Mod(h, 2)-1)))
+	c := uint8(255 * v)
+	switch int(h) {
+	case 0:
+		return color.RGBA{c, x, 0, 255}
+	case 1:
+		return color.RGBA{x, c, 0, 255}
+	case 2:
+		return color.RGBA{0, c, x, 255}
+	case 3:
+		return color.RGBA{0, x, c, 255}
+	case 4:
+		return color.RGBA{x, 0, c, 255}
+	}
+	return color.RGBA{c, 0, x, 255}
+}
+
+type plasma struct{}
+
+func newPlasma(params url.Values) frameSource {
+	return &plasma{}
+}
+
+func (p *plasma) Frame(t time.Duration, img *image.RGBA) bool {
+	ts := t.Seconds()
+	for y := 0; y < matrixHeight; y++ {
+		for x := 0; x < matrixWidth; x++ {
+			fx := float64(x) / float64(matrixWidth) * 8
+			fy := float64(y) / float64(matrixHeight) * 8
+			v := math.Sin(fx+ts) +
+				math.Sin((fy+ts)/2) +
+				math.Sin((fx+fy+ts)/2) +
+				math.Sin(math.Sqrt(fx*fx+fy*fy+1)+ts)
+			img.SetRGBA(x, y, hsv(v/8+ts/10, 1))
+		}
+	}
+	return true
+}
+
+// fire is the classic demoscene fire: heat rises from the bottom row and
+// randomly cools down on its way up.
+type fire struct {
+	heat []uint8
+}
+
+func newFire(params url.Values) frameSource {
+	return &fire{
+		heat: make([]uint8, matrixWidth*matrixHeight),
+	}
+}
+
+func firePalette(h uint8) color.RGBA {
+	v := int(h)
+	switch {
+	case v < 85:
+		return color.RGBA{uint8(v * 3), 0, 0, 255}
+	case v < 170:
+		return color.RGBA{255, uint8((v - 85) * 3), 0, 255}
+	}
+	return color.RGBA{255, 255, uint8((v - 170) * 3), 255}
+}
+
+func (f *fire) Frame(t time.Duration, img *image.RGBA) bool {
+	w, h := matrixWidth, matrixHeight
+	for x := 0; x < w; x++ {
+		f.heat[(h-1)*w+x] = uint8(200 + rand.Intn(55))
+	}
+	for y := 0; y < h-1; y++ {
+		for x := 0; x < w; x++ {
+			src := (y+1)*w + x
+			drift := rand.Intn(3) - 1
+			dst := y*w + x + drift
+			if dst < y*w || dst >= (y+1)*w {
+				dst = y*w + x
+			}
+			cooling := uint8(rand.Intn(3) * 256 / h)
+			if f.heat[src] > cooling {
+				f.heat[dst] = f.heat[src] - cooling
+			} else {
+				f.heat[dst] = 0
+			}
+		}
+	}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.SetRGBA(x, y, firePalette(f.heat[y*w+x]))
+		}
+	}
+	return true
+}
+
+// life runs Conway's Game of Life on a torus, coloring cells by their age.
+type life struct {
+	cells      []int
+	next       []int
+	generation int
+	lastStep   time.Duration
+}
+
+func newLife(params url.Values) frameSource {
+	l := &life{
+		cells: make([]int, matrixWidth*matrixHeight),
+		next:  make([]int, matrixWidth*matrixHeight),
+	}
+	l.seed()
+	return l
+}
+
+func (l *life) seed() {
+	for i := range l.cells {
+		l.cells[i] = 0
+		if rand.Intn(4) == 0 {
+			l.cells[i] = 1
+		}
+	}
+	l.generation = 0
+}
+
+// step advances the simulation, returning false if nothing changed.
+func (l *life) step() bool {
+	w, h := matrixWidth, matrixHeight
+	changed := false
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			n := 0
+			for dy := -1; dy <= 1; dy++ {
+				for dx := -1; dx <= 1; dx++ {
+					if dx == 0 && dy == 0 {
+						continue
+					}
+					if l.cells[((y+dy+h)%h)*w+(x+dx+w)%w] > 0 {
+						n++
+					}
+				}
+			}
+			i := y*w + x
+			alive := l.cells[i] > 0
+			switch {
+			case alive && (n == 2 || n == 3):
+				l.next[i] = l.cells[i] + 1
+			case !alive && n == 3:
+				l.next[i] = 1
+				changed = true
+			default:
+				l.next[i] = 0
+				if alive {
+					changed = true
+				}
+			}
+		}
+	}
+	l.cells, l.next = l.next, l.cells
+	l.generation++
+	return changed
+}
+
+func (l *life) Frame(t time.Duration, img *image.RGBA) bool {
+	for t-l.lastStep >= time.Second/kLifeRate {
+		l.lastStep += time.Second / kLifeRate
+		if !l.step() || l.generation > kLifeMaxGenerations {
+			l.seed()
+		}
+	}
+	for i, age := range l.cells {
+		c := color.RGBA{0, 0, 0, 255}
+		if age > 0 {
+			c = hsv(math.Min(float64(age), 60)/180, 1)
+		}
+		img.SetRGBA(i%matrixWidth, i/matrixWidth, c)
+	}
+	return true
+}
+
+type star struct {
+	x, y, z float64
+}
+
+// starfield flies through randomly placed stars.
+type starfield struct {
+	stars []star
+	last  time.Duration
+}
+
+func newStarfield(params url.Values) frameSource {
+	s := &starfield{}
+	for i := 0; i < kStarCount; i++ {
+		s.stars = append(s.stars, randomStar(rand.Float64()))
+	}
+	return s
+}
+
+func randomStar(z float64) star {
+	return star{
+		x: rand.Float64()*2 - 1,
+		y: rand.Float64()*2 - 1,
+		z: z,
+	}
+}
+
+func (s *starfield) Frame(t time.Duration, img *image.RGBA) bool {
+	dt := (t - s.last).Seconds()
+	s.last = t
+	fill(img, color.RGBA{0, 0, 0, 255})
+	cx, cy := float64(matrixWidth)/2, float64(matrixHeight)/2
+	for i := range s.stars {
+		st := &s.stars[i]
+		st.z -= dt / 4
+		if st.z <= 0.01 {
+			*st = randomStar(1)
+		}
+		x := int(cx + st.x/st.z*cx)
+		y := int(cy + st.y/st.z*cy)
+		if !(image.Point{x, y}).In(img.Rect) {
+			*st = randomStar(1)
+			continue
+		}
+		v := uint8(255 * (1 - st.z))
+		img.SetRGBA(x, y, color.RGBA{v, v, v, 255})
+	}
+	return true
+}
+
+// clock shows the current time, as large as fits the matrix.
+type clock struct {
+	started time.Time
+	color   color.RGBA
+}
+
+func newClock(params url.Values) frameSource {
+	c := &clock{
+		started: time.Now(),
+		color:   rgb(0),
+	}
+	if s := params.Get("color"); s != "" {
+		if v, err := strconv.ParseUint(s, 16, 32); err == nil {
+			c.color = rgb(uint32(v))
+		}
+	}
+	return c
+}
+
+func (c *clock) Frame(t time.Duration, img *image.RGBA) bool {
+	// Frames are rendered ahead of being shown, so derive the time from the
+	// frame timestamp instead of the wall clock.
+	now := c.started.Add(t)
+	s := now.Format("15:04:05")
+	scale := matrixWidth / textWidth(s, 1)
+	if scale < 1 {
+		s = now.Format("15:04")
+		scale = 1
+	}
+	fill(img, color.RGBA{0, 0, 0, 255})
+	x := (matrixWidth - textWidth(s, scale)) / 2
+	y := (matrixHeight - textHeight(scale)) / 2
+	drawText(img, x, y, s, c.color, scale)
+	return true
+}
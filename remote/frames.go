@@ -0,0 +1,90 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"io"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+)
+
+// frameSource generates frames to be shown on the matrix.
+type frameSource interface {
+	// Frame draws the frame at time t since the source was started into
+	// img. It returns false once the source has nothing more to show.
+	Frame(t time.Duration, img *image.RGBA) bool
+}
+
+// writeFrames renders frames from a source starting at offset and writes
+// them as raw RGB24 into w, until the source finishes or the write fails
+// (usually because mpv got killed). If overlaid is set, the overlay is
+// composited on top of every frame.
+func writeFrames(src frameSource, offset time.Duration, w io.WriteCloser, overlaid bool) {
+	defer w.Close()
+	img := image.NewRGBA(image.Rect(0, 0, matrixWidth, matrixHeight))
+	scratch := image.NewRGBA(img.Rect)
+	buf := make([]byte, matrixWidth*matrixHeight*3)
+	interval := time.Second / time.Duration(frameRate)
+	started := time.Now()
+	for i := 0; ; i++ {
+		t := offset + time.Duration(i)*interval
+		if !src.Frame(t, img) {
+			return
+		}
+		if overlaid {
+			overlayFrame(img, scratch, started.Add(t-offset))
+		}
+		for p := 0; p < matrixWidth*matrixHeight; p++ {
+			buf[p*3+0] = img.Pix[p*4+0]
+			buf[p*3+1] = img.Pix[p*4+1]
+			buf[p*3+2] = img.Pix[p*4+2]
+		}
+		if _, err := w.Write(buf); err != nil {
+			glog.Infof("Stopped writing frames: %v", err)
+			return
+		}
+	}
+}
+
+func fill(img *image.RGBA, c color.RGBA) {
+	for p := 0; p < len(img.Pix); p += 4 {
+		img.Pix[p+0] = c.R
+		img.Pix[p+1] = c.G
+		img.Pix[p+2] = c.B
+		img.Pix[p+3] = c.A
+	}
+}
+
+func PlayFrames(ctx context.Context, src frameSource, done chan error) error {
+	processMutex.Lock()
+	defer processMutex.Unlock()
+	stop(ctx)
+	return start(ctx, &playback{source: src, done: done})
+}
+
+// Show displays a transient frame source in place of whatever is playing,
+// and resumes the previous playback once the source finishes.
+func Show(ctx context.Context, src frameSource) error {
+	done := make(chan error, 1)
+	processMutex.Lock()
+	suspend(ctx)
+	err := start(ctx, &playback{source: src, done: done, transient: true})
+	if err != nil {
+		resume(ctx)
+		processMutex.Unlock()
+		return err
+	}
+	processMutex.Unlock()
+
+	err = <-done
+
+	processMutex.Lock()
+	defer processMutex.Unlock()
+	// Only resume if nobody started anything else in the meantime.
+	if current == nil {
+		resume(ctx)
+	}
+	return err
+}
@@ -1,14 +1,19 @@
 package main
 
 import (
+	"bufio"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"image/color"
+	"io"
 	"io/ioutil"
 	"net"
 	"os"
 	"os/exec"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -16,10 +21,16 @@ import (
 	"golang.org/x/net/context"
 	"golang.org/x/net/trace"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 
 	pb "github.com/q3k/webled/proto"
 )
 
+const (
+	// mpv protocol following a file as it grows.
+	kAppendingPrefix = "appending://"
+)
+
 var (
 	mpvArgs = []string{
 		"#FNAME#",
@@ -27,13 +38,67 @@ var (
 		"-vo", "led",
 		"-ao", "pulse:10.8.1.16",
 	}
-	process       *os.Process
+	// Additional arguments used when playing back frames generated by the
+	// remote itself, fed to mpv through stdin.
+	mpvFrameArgs = []string{
+		"--demuxer=rawvideo",
+		"--demuxer-rawvideo-mp-format=rgb24",
+		"--demuxer-rawvideo-w=#WIDTH#",
+		"--demuxer-rawvideo-h=#HEIGHT#",
+		"--demuxer-rawvideo-fps=#FPS#",
+		"--cache=no",
+	}
+	current       *playback
+	suspended     *playback
 	processMutex  sync.Mutex
 	mpvSocketName string
 	mpvSocket     net.Conn
+	mpvReader     *bufio.Reader
+	mpvMutex      sync.Mutex
 	bindPort      int
+	matrixWidth   int
+	matrixHeight  int
+	frameRate     int
+	cacheDir      string
+	cacheSize     int64
+	cache         *mediaCache
 )
 
+var errInterrupted = errors.New("Interrupted.")
+
+// playback is something shown on the matrix: either a file played by mpv, or
+// frames generated by a frameSource and piped into mpv.
+type playback struct {
+	file   string
+	source frameSource
+	// Position from which playback was (re)started.
+	offset  time.Duration
+	started time.Time
+	done    chan error
+	process *os.Process
+	// Set when the playback is stopped in order to be resumed later, so that
+	// its exit is not reported as the end of playback.
+	suspended bool
+	// Transient playbacks (like text messages) are shown in place of whatever
+	// was playing, which is resumed once they finish.
+	transient bool
+}
+
+func (p *playback) position(ctx context.Context) time.Duration {
+	if p.file != "" {
+		ctx, cancel := context.WithTimeout(ctx, time.Second)
+		defer cancel()
+		pos, err := mpvRPC(ctx, "get_property_string", "time-pos")
+		if err == nil {
+			if f, err := strconv.ParseFloat(pos, 64); err == nil {
+				return time.Duration(f * float64(time.Second))
+			}
+		}
+		glog.Warningf("Could not get playback position from mpv: %v", err)
+	}
+	return p.offset + time.Since(p.started)
+}
+
 func blank(ctx context.Context) {
 	//TODO(q3k): implement this
 }
@@ -45,45 +110,94 @@ func Stop(ctx context.Context) {
 }
 
 func stop(ctx context.Context) {
-	if process == nil {
+	if suspended != nil {
+		suspended.done <- errInterrupted
+		suspended = nil
+	}
+	if current == nil {
 		return
 	}
 	glog.Info("Stopping previous process...")
 	if tr, ok := trace.FromContext(ctx); ok {
 		tr.LazyPrintf("Stopping previous process...")
 	}
-	process.Kill()
+	current.process.Kill()
 	blank(ctx)
 }
 
+// suspend stops the current playback so that it can be resumed later.
+func suspend(ctx context.Context) {
+	if current == nil {
+		return
+	}
+	if current.transient || suspended != nil {
+		// Only keep the first non-transient playback around.
+		current.process.Kill()
+		return
+	}
+	current.offset = current.position(ctx)
+	current.suspended = true
+	suspended = current
+	glog.Infof("Suspending playback at %v...", current.offset)
+	current.process.Kill()
+}
+
+// resume restarts a previously suspended playback, if any.
+func resume(ctx context.Context) {
+	if suspended == nil {
+		return
+	}
+	p := suspended
+	suspended = nil
+	p.suspended = false
+	glog.Infof("Resuming playback at %v...", p.offset)
+	if err := start(ctx, p); err != nil {
+		p.done <- err
+	}
+}
+
 // See JSON IPC in mpv(1)
 type MPVCommand struct {
 	Command []string `json:"command"`
 }
 
 type MPVResponse struct {
-	Error string `json:"error"`
-	Data  string `json:"data"`
+	Error string          `json:"error"`
+	Data  json.RawMessage `json:"data"`
+	Event string          `json:"event"`
 }
 
-func mpvReconnect(ctx context.Context) {
+func mpvReconnect(ctx context.Context) error {
 	for {
 		if mpvSocket != nil {
-			return
+			return nil
 		}
 		glog.Infof("Connecting to %s...", mpvSocketName)
 		s, err := net.Dial("unix", mpvSocketName)
 		if err == nil {
 			mpvSocket = s
+			mpvReader = bufio.NewReader(s)
 			glog.Info("Connected!")
-			return
+			return nil
 		}
 		glog.Warningf("Could not connect to %s: %v", mpvSocketName, err)
-		time.Sleep(time.Second)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
 	}
 }
 
+func mpvDisconnect() {
+	mpvSocket.Close()
+	mpvSocket = nil
+}
+
 func mpvRPC(ctx context.Context, args ...string) (string, error) {
+	mpvMutex.Lock()
+	defer mpvMutex.Unlock()
+
 	command := MPVCommand{Command: args}
 	commandBytes, err := json.Marshal(command)
 	if err != nil {
@@ -91,42 +205,56 @@ func mpvRPC(ctx context.Context, args ...string) (string, error) {
 	}
 	commandBytes = append(commandBytes, '\n')
 
-	mpvReconnect(ctx)
+	if err := mpvReconnect(ctx); err != nil {
+		return "", err
+	}
 	for {
 		_, err = mpvSocket.Write(commandBytes)
 		if err == nil {
 			break
 		}
-		mpvSocket = nil
+		mpvDisconnect()
 		glog.Warningf("Could not send data to %s: %v", mpvSocketName, err)
-		mpvReconnect(ctx)
-	}
-	responseBytes := make([]byte, 1024)
-	n, err := mpvSocket.Read(responseBytes)
-	if err != nil {
-		return "", nil
+		if err := mpvReconnect(ctx); err != nil {
+			return "", err
+		}
 	}
-	responseBytes = responseBytes[:n]
-	response := MPVResponse{}
-	err = json.Unmarshal(responseBytes, &response)
-	if err != nil {
-		return "", err
+	if deadline, ok := ctx.Deadline(); ok {
+		mpvSocket.SetReadDeadline(deadline)
+	} else {
+		mpvSocket.SetReadDeadline(time.Time{})
 	}
-	if response.Error != "success" {
-		return "", errors.New(response.Error)
+	for {
+		responseBytes, err := mpvReader.ReadBytes('\n')
+		if err != nil {
+			mpvDisconnect()
+			return "", err
+		}
+		response := MPVResponse{}
+		err = json.Unmarshal(responseBytes, &response)
+		if err != nil {
+			return "", err
+		}
+		if response.Event != "" {
+			// Asynchronous event, not a reply to our command.
+			continue
+		}
+		if response.Error != "success" {
+			return "", errors.New(response.Error)
+		}
+		var data string
+		if err := json.Unmarshal(response.Data, &data); err == nil {
+			return data, nil
+		}
+		return string(response.Data), nil
 	}
-	return response.Data, nil
-}
-
-func Play(ctx context.Context, file string, done chan error) error {
-	processMutex.Lock()
-	defer processMutex.Unlock()
-	return play(ctx, file, done)
 }
 
-func play(ctx context.Context, file string, done chan error) error {
-	stop(ctx)
-
+func mpvCommandLine(p *playback) []string {
+	file := p.file
+	if p.source != nil {
+		file = "-"
+	}
 	args := []string{}
 	for _, a := range mpvArgs {
 		if a == "#FNAME#" {
@@ -136,38 +264,132 @@ func play(ctx context.Context, file string, done chan error) error {
 		}
 		args = append(args, a)
 	}
+	if p.source != nil {
+		for _, a := range mpvFrameArgs {
+			a = strings.Replace(a, "#WIDTH#", strconv.Itoa(matrixWidth), -1)
+			a = strings.Replace(a, "#HEIGHT#", strconv.Itoa(matrixHeight), -1)
+			a = strings.Replace(a, "#FPS#", strconv.Itoa(frameRate), -1)
+			args = append(args, a)
+		}
+	} else if p.offset > 0 {
+		args = append(args, fmt.Sprintf("--start=+%.3f", p.offset.Seconds()))
+	}
+	return args
+}
 
+// start launches mpv for a playback and makes it current. The playback's done
+// channel receives the result once it finishes, unless it gets suspended.
+func start(ctx context.Context, p *playback) error {
+	args := mpvCommandLine(p)
 	glog.Infof("Starting mpv with arguments: %v", args)
 	if tr, ok := trace.FromContext(ctx); ok {
 		tr.LazyPrintf("Starting mpv with arguments: %v", args)
 	}
 	cmd := exec.Command("./mpv", args...)
+	var frames io.WriteCloser
+	if p.source != nil {
+		var err error
+		frames, err = cmd.StdinPipe()
+		if err != nil {
+			return err
+		}
+	}
 	err := cmd.Start()
 	if err != nil {
 		return err
 	}
-	process = cmd.Process
-	glog.Infof("Set process to %v", process)
+	p.process = cmd.Process
+	p.started = time.Now()
+	current = p
+	glog.Infof("Set process to %v", p.process)
+	if p.source != nil {
+		go writeFrames(p.source, p.offset, frames, !p.transient)
+	}
 	go func() {
 		res := cmd.Wait()
+		processMutex.Lock()
+		defer processMutex.Unlock()
+		if p.process != cmd.Process {
+			// Playback was suspended and restarted since.
+			return
+		}
+		if current == p {
+			current = nil
+		}
+		if p.suspended {
+			return
+		}
 		if res == nil {
 			// Video playback not interrupted - blank the screen.
 			blank(ctx)
 		}
-		done <- res
+		p.done <- res
 	}()
 	return nil
 }
 
+func Play(ctx context.Context, file string, done chan error) error {
+	processMutex.Lock()
+	defer processMutex.Unlock()
+	return play(ctx, file, done)
+}
+
+func play(ctx context.Context, file string, done chan error) error {
+	stop(ctx)
+	return start(ctx, &playback{file: file, done: done})
+}
+
 type remoteServer struct {
 }
 
+// resolve maps a filename requested by webled to a local path, preferring the
+// cache. Files that are neither cached nor present locally are reported as
+// NotFound so that webled can upload them.
+func resolve(filename string) (string, error) {
+	if cache == nil {
+		return filename, nil
+	}
+	if path, ok := cache.Lookup(filename); ok {
+		return path, nil
+	}
+	if _, err := os.Stat(filename); err != nil {
+		return "", grpc.Errorf(codes.NotFound, "%s not cached.", filename)
+	}
+	return filename, nil
+}
+
 func (r *remoteServer) Play(ctx context.Context, in *pb.PlayRequest) (*pb.PlayResponse, error) {
 	if in.Filename == "" {
 		return nil, errors.New("No filename specified.")
 	}
 	res := make(chan error, 1)
-	Play(ctx, in.Filename, res)
+	if strings.HasPrefix(in.Filename, kEffectPrefix) {
+		src, err := parseEffect(in.Filename)
+		if err != nil {
+			return nil, grpc.Errorf(codes.InvalidArgument, "%v", err)
+		}
+		if err := PlayFrames(ctx, src, res); err != nil {
+			return nil, err
+		}
+	} else if in.Growing {
+		if _, err := os.Stat(in.Filename); err != nil {
+			return nil, grpc.Errorf(codes.NotFound, "%s not present.", in.Filename)
+		}
+		// Keep reading as the file grows instead of stopping at its current
+		// end.
+		if err := Play(ctx, kAppendingPrefix+in.Filename, res); err != nil {
+			return nil, err
+		}
+	} else {
+		path, err := resolve(in.Filename)
+		if err != nil {
+			return nil, err
+		}
+		if err := Play(ctx, path, res); err != nil {
+			return nil, err
+		}
+	}
+	SetTitle(in.Title)
 	err := <-res
 	if err != nil {
 		return nil, err
@@ -184,16 +406,130 @@ func (r *remoteServer) Interrupt(ctx context.Context, in *pb.InterruptRequest) (
 	return &pb.InterruptResponse{}, nil
 }
 
+func (r *remoteServer) ShowText(ctx context.Context, in *pb.ShowTextRequest) (*pb.ShowTextResponse, error) {
+	if in.Text == "" {
+		return nil, errors.New("No text specified.")
+	}
+	duration := time.Duration(in.DurationMs) * time.Millisecond
+	src := newTextSource(in.Text, rgb(in.Color), int(in.Scale), in.Scroll, duration)
+	if err := Show(ctx, src); err != nil {
+		return nil, err
+	}
+	return &pb.ShowTextResponse{}, nil
+}
+
+func (r *remoteServer) SetOverlay(ctx context.Context, in *pb.SetOverlayRequest) (*pb.SetOverlayResponse, error) {
+	badgeColor := color.RGBA{255, 0, 0, 255}
+	if in.BadgeColor != 0 {
+		badgeColor = rgb(in.BadgeColor)
+	}
+	SetOverlay(overlayConfig{
+		clock:      in.Clock,
+		title:      in.Title,
+		badge:      in.Badge,
+		color:      rgb(in.Color),
+		badgeColor: badgeColor,
+	})
+	return &pb.SetOverlayResponse{}, nil
+}
+
+func cacheEntryProto(e cacheEntry) *pb.CacheEntry {
+	return &pb.CacheEntry{
+		Name:     e.Name,
+		Sha256:   e.SHA256,
+		Size:     e.Size,
+		LastUsed: e.LastUsed.Unix(),
+	}
+}
+
+func (r *remoteServer) PutFile(stream pb.RemoteVideo_PutFileServer) error {
+	if cache == nil {
+		return grpc.Errorf(codes.FailedPrecondition, "Cache disabled.")
+	}
+	first, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		chunk := first
+		for {
+			if _, err := pw.Write(chunk.Data); err != nil {
+				return
+			}
+			var err error
+			chunk, err = stream.Recv()
+			if err == io.EOF {
+				pw.Close()
+				return
+			}
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+	}()
+	glog.Infof("Receiving %s into cache...", first.Name)
+	e, err := cache.Put(first.Name, first.Sha256, pr)
+	pr.Close()
+	if err != nil {
+		return err
+	}
+	return stream.SendAndClose(&pb.PutFileResponse{Entry: cacheEntryProto(*e)})
+}
+
+func (r *remoteServer) ListCache(ctx context.Context, in *pb.ListCacheRequest) (*pb.ListCacheResponse, error) {
+	if cache == nil {
+		return &pb.ListCacheResponse{}, nil
+	}
+	entries, size := cache.List()
+	res := &pb.ListCacheResponse{
+		Size:  size,
+		Limit: cache.limit,
+	}
+	for _, e := range entries {
+		res.Entries = append(res.Entries, cacheEntryProto(e))
+	}
+	return res, nil
+}
+
+func (r *remoteServer) EvictFile(ctx context.Context, in *pb.EvictFileRequest) (*pb.EvictFileResponse, error) {
+	if cache == nil {
+		return nil, grpc.Errorf(codes.FailedPrecondition, "Cache disabled.")
+	}
+	if err := cache.Evict(in.Name); err != nil {
+		return nil, grpc.Errorf(codes.NotFound, "%v", err)
+	}
+	return &pb.EvictFileResponse{}, nil
+}
+
 func main() {
 	flag.IntVar(&bindPort, "port", 8080, "Port on which to bind GRPC server to.")
+	flag.IntVar(&matrixWidth, "width", 128, "Width of the LED matrix in pixels.")
+	flag.IntVar(&matrixHeight, "height", 128, "Height of the LED matrix in pixels.")
+	flag.IntVar(&frameRate, "fps", 30, "Frame rate of content generated by the remote.")
+	flag.StringVar(&cacheDir, "cache_dir", "cache", "Directory in which to keep files uploaded by webled. Empty to disable the cache.")
+	flag.Int64Var(&cacheSize, "cache_size", 1024, "Maximum size of the cache in MiB, 0 for unlimited.")
+	flag.StringVar(&tlsCertFile, "tls_cert", "", "TLS certificate to serve GRPC with. Plaintext if not set.")
+	flag.StringVar(&tlsKeyFile, "tls_key", "", "Private key for the TLS certificate.")
+	flag.StringVar(&tlsClientCAFile, "tls_client_ca", "", "CA bundle to verify client certificates against. Enables mutual TLS.")
+	flag.StringVar(&authTokenFile, "auth_token_file", "", "File containing a bearer token that clients must present.")
 	flag.Parse()
 	glog.Info("Starting webled remote...")
-	process = nil
+	if cacheDir != "" {
+		var err error
+		cache, err = newMediaCache(cacheDir, cacheSize*1024*1024)
+		if err != nil {
+			glog.Exit(err)
+		}
+	}
 	tmpDir, err := ioutil.TempDir("", "remote")
 	if err != nil {
 		glog.Error(err)
 	}
 	mpvSocketName = fmt.Sprintf("%s/mpv.socket", tmpDir)
+	overlayDir = tmpDir
+	go overlayLoop()
 	defer func() {
 		Stop(context.Background())
 		os.RemoveAll(tmpDir)
@@ -203,7 +539,11 @@ func main() {
 	if err != nil {
 		glog.Exit(err)
 	}
-	grpcServer := grpc.NewServer()
+	opts, err := serverOptions()
+	if err != nil {
+		glog.Exit(err)
+	}
+	grpcServer := grpc.NewServer(opts...)
 	pb.RegisterRemoteVideoServer(grpcServer, &remoteServer{})
 	glog.Exit(grpcServer.Serve(lis))
 }
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+)
+
+const (
+	// How often the overlay is re-rendered for videos played by mpv.
+	kOverlayInterval = 200 * time.Millisecond
+	// How long the title of a video is shown after it starts.
+	kTitleDuration = 10 * time.Second
+	// ID of our overlay in mpv.
+	kOverlayID = "0"
+)
+
+// overlayConfig describes what gets composited on top of everything that is
+// played.
+type overlayConfig struct {
+	clock      bool
+	title      bool
+	badge      string
+	color      color.RGBA
+	badgeColor color.RGBA
+}
+
+var (
+	overlayMutex      sync.Mutex
+	overlay           overlayConfig
+	overlayTitle      string
+	overlayTitleStart time.Time
+	overlayDir        string
+)
+
+func SetOverlay(c overlayConfig) {
+	overlayMutex.Lock()
+	defer overlayMutex.Unlock()
+	overlay = c
+}
+
+// SetTitle sets the title of whatever started playing, to be shown for a while
+// if enabled.
+func SetTitle(title string) {
+	overlayMutex.Lock()
+	defer overlayMutex.Unlock()
+	overlayTitle = title
+	overlayTitleStart = time.Now()
+}
+
+// backdrop darkens a rectangle behind overlay text to keep it readable.
+func backdrop(img *image.RGBA, r image.Rectangle) {
+	r = r.Inset(-1).Intersect(img.Rect)
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			img.SetRGBA(x, y, color.RGBA{0, 0, 0, 192})
+		}
+	}
+}
+
+// renderOverlay draws the overlay as of now into img, which should be fully
+// transparent. It returns false if there was nothing to draw.
+func renderOverlay(img *image.RGBA, now time.Time) bool {
+	overlayMutex.Lock()
+	c := overlay
+	title := overlayTitle
+	titleAge := now.Sub(overlayTitleStart)
+	overlayMutex.Unlock()
+
+	drawn := false
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+	if c.clock {
+		s := now.Format("15:04")
+		x := w - textWidth(s, 1) - 1
+		y := h - textHeight(1) - 1
+		backdrop(img, image.Rect(x, y, x+textWidth(s, 1), y+textHeight(1)))
+		drawText(img, x, y, s, c.color, 1)
+		drawn = true
+	}
+	if c.title && title != "" && titleAge < kTitleDuration {
+		travelled := int(titleAge.Seconds() * kScrollSpeed)
+		tw := textWidth(title, 1)
+		if travelled < w+tw {
+			backdrop(img, image.Rect(0, 1, w, 1+textHeight(1)))
+			drawText(img, w-travelled, 1, title, c.color, 1)
+			drawn = true
+		}
+	}
+	if c.badge != "" {
+		x := w - textWidth(c.badge, 1) - 1
+		y := 1
+		if c.title && title != "" && titleAge < kTitleDuration {
+			y += textHeight(1) + kLineSpacing
+		}
+		r := image.Rect(x, y, x+textWidth(c.badge, 1), y+textHeight(1))
+		for py := r.Min.Y - 1; py < r.Max.Y+1; py++ {
+			for px := r.Min.X - 1; px < r.Max.X+1; px++ {
+				if (image.Point{px, py}).In(img.Rect) {
+					img.SetRGBA(px, py, c.badgeColor)
+				}
+			}
+		}
+		drawText(img, x, y, c.badge, color.RGBA{255, 255, 255, 255}, 1)
+		drawn = true
+	}
+	return drawn
+}
+
+// composite blends a non-premultiplied overlay on top of an opaque frame.
+func composite(dst, src *image.RGBA) {
+	for p := 0; p < len(dst.Pix); p += 4 {
+		a := uint32(src.Pix[p+3])
+		if a == 0 {
+			continue
+		}
+		for i := 0; i < 3; i++ {
+			dst.Pix[p+i] = uint8((uint32(src.Pix[p+i])*a + uint32(dst.Pix[p+i])*(255-a)) / 255)
+		}
+	}
+}
+
+// overlayFrame composites the overlay onto a generated frame shown at time
+// now.
+func overlayFrame(img, scratch *image.RGBA, now time.Time) {
+	for i := range scratch.Pix {
+		scratch.Pix[i] = 0
+	}
+	if renderOverlay(scratch, now) {
+		composite(img, scratch)
+	}
+}
+
+// toBGRA converts an overlay into premultiplied BGRA, as expected by mpv's
+// overlay-add.
+func toBGRA(img *image.RGBA, buf []byte) {
+	for p := 0; p < len(img.Pix); p += 4 {
+		a := uint32(img.Pix[p+3])
+		buf[p+0] = uint8(uint32(img.Pix[p+2]) * a / 255)
+		buf[p+1] = uint8(uint32(img.Pix[p+1]) * a / 255)
+		buf[p+2] = uint8(uint32(img.Pix[p+0]) * a / 255)
+		buf[p+3] = uint8(a)
+	}
+}
+
+// overlayLoop keeps mpv's overlay up to date while it is playing a file.
+// Generated frames get the overlay composited in writeFrames instead.
+func overlayLoop() {
+	img := image.NewRGBA(image.Rect(0, 0, matrixWidth, matrixHeight))
+	buf := make([]byte, len(img.Pix))
+	shown := []byte{}
+	var shownOn *os.Process
+	// Alternate between two files, so that mpv never reads a half-written
+	// one.
+	flip := 0
+	for {
+		time.Sleep(kOverlayInterval)
+
+		processMutex.Lock()
+		var p *os.Process
+		if current != nil && current.file != "" {
+			p = current.process
+		}
+		processMutex.Unlock()
+		if p == nil {
+			shownOn = nil
+			continue
+		}
+
+		for i := range img.Pix {
+			img.Pix[i] = 0
+		}
+		drawn := renderOverlay(img, time.Now())
+		toBGRA(img, buf)
+		if p == shownOn && bytes.Equal(buf, shown) {
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		var err error
+		if drawn {
+			flip = 1 - flip
+			path := fmt.Sprintf("%s/overlay-%d.bgra", overlayDir, flip)
+			if err = ioutil.WriteFile(path, buf, 0644); err == nil {
+				_, err = mpvRPC(ctx, "overlay-add", kOverlayID, "0", "0", path, "0", "bgra",
+					strconv.Itoa(matrixWidth), strconv.Itoa(matrixHeight), strconv.Itoa(matrixWidth*4))
+			}
+		} else if p == shownOn {
+			_, err = mpvRPC(ctx, "overlay-remove", kOverlayID)
+		}
+		cancel()
+		if err != nil {
+			glog.Warningf("Could not update overlay: %v", err)
+			continue
+		}
+		shownOn = p
+		shown = append(shown[:0], buf...)
+	}
+}
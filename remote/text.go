@@ -0,0 +1,110 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"strings"
+	"time"
+)
+
+const (
+	kDefaultTextDuration = 5 * time.Second
+	// Pixels per second, at scale 1.
+	kScrollSpeed = 30
+)
+
+// textSource renders a message, either centered and word wrapped, or
+// scrolling horizontally across the middle of the matrix.
+type textSource struct {
+	text     string
+	lines    []string
+	color    color.RGBA
+	scale    int
+	scroll   bool
+	duration time.Duration
+}
+
+func newTextSource(text string, c color.RGBA, scale int, scroll bool, duration time.Duration) *textSource {
+	if scale < 1 {
+		scale = 1
+	}
+	if !scroll && duration == 0 {
+		duration = kDefaultTextDuration
+	}
+	return &textSource{
+		text:     text,
+		lines:    wrapText(text, matrixWidth, scale),
+		color:    c,
+		scale:    scale,
+		scroll:   scroll,
+		duration: duration,
+	}
+}
+
+// wrapText breaks text into lines that fit within width pixels, breaking on
+// spaces where possible.
+func wrapText(text string, width, scale int) []string {
+	lines := []string{}
+	line := ""
+	for _, word := range strings.Fields(text) {
+		candidate := word
+		if line != "" {
+			candidate = line + " " + word
+		}
+		if textWidth(candidate, scale) <= width || line == "" {
+			line = candidate
+		} else {
+			lines = append(lines, line)
+			line = word
+		}
+		// Hard-break words that do not fit on a line of their own.
+		for textWidth(line, scale) > width && len(line) > 1 {
+			n := width / ((kGlyphWidth + kGlyphSpacing) * scale)
+			if n < 1 {
+				n = 1
+			}
+			lines = append(lines, line[:n])
+			line = line[n:]
+		}
+	}
+	if line != "" {
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func (s *textSource) Frame(t time.Duration, img *image.RGBA) bool {
+	if s.duration > 0 && t >= s.duration {
+		return false
+	}
+	fill(img, color.RGBA{0, 0, 0, 255})
+
+	if s.scroll {
+		w := textWidth(s.text, s.scale)
+		travelled := int(t.Seconds() * kScrollSpeed * float64(s.scale))
+		if s.duration == 0 && travelled > matrixWidth+w {
+			return false
+		}
+		x := matrixWidth - travelled%(matrixWidth+w)
+		y := (matrixHeight - textHeight(s.scale)) / 2
+		drawText(img, x, y, s.text, s.color, s.scale)
+		return true
+	}
+
+	lineHeight := textHeight(s.scale) + kLineSpacing*s.scale
+	y := (matrixHeight - len(s.lines)*lineHeight + kLineSpacing*s.scale) / 2
+	for _, line := range s.lines {
+		x := (matrixWidth - textWidth(line, s.scale)) / 2
+		drawText(img, x, y, line, s.color, s.scale)
+		y += lineHeight
+	}
+	return true
+}
+
+// rgb converts a 0xRRGGBB value into a color, treating 0 as white.
+func rgb(v uint32) color.RGBA {
+	if v == 0 {
+		return color.RGBA{255, 255, 255, 255}
+	}
+	return color.RGBA{uint8(v >> 16), uint8(v >> 8), uint8(v), 255}
+}
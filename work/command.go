@@ -0,0 +1,217 @@
+package work
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/trace"
+)
+
+const (
+	// Longest line of command output that is looked at. Longer lines fail
+	// the job, once the rest of the output has been drained.
+	kMaxLineSize = 1024 * 1024
+)
+
+// Progress of a running request, as far as it can be told.
+type Progress struct {
+	Percent float64 `json:"percent"`
+	Speed   string  `json:"speed"`
+	ETA     string  `json:"eta"`
+	// Bytes of output written so far, if known.
+	Size int64 `json:"size"`
+}
+
+func (r *WorkRequest) Progress() Progress {
+	r.progressMutex.Lock()
+	defer r.progressMutex.Unlock()
+	return r.progress
+}
+
+func (r *WorkRequest) setProgress(p Progress) {
+	r.progressMutex.Lock()
+	defer r.progressMutex.Unlock()
+	r.progress = p
+	r.publishProgress()
+}
+
+type requestKey struct{}
+
+// SetProgress reports the progress of the job run with ctx. It does nothing
+// outside of a job.
+func SetProgress(ctx context.Context, p Progress) {
+	if r, ok := ctx.Value(requestKey{}).(*WorkRequest); ok {
+		r.setProgress(p)
+	}
+}
+
+// progressWriter reports the progress of writing total bytes.
+type progressWriter struct {
+	ctx     context.Context
+	total   int64
+	written int64
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	w.written += int64(len(p))
+	if w.total > 0 {
+		SetProgress(w.ctx, Progress{Percent: 100 * float64(w.written) / float64(w.total), Size: w.written})
+	}
+	return len(p), nil
+}
+
+// scanLines splits output on both \n and \r, as progress meters like to
+// redraw a single line.
+func scanLines(data []byte, atEOF bool) (int, []byte, error) {
+	if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// runCommand runs a command within the context of a job, passing every line
+// of its stdout to onLine, if set. Everything the command prints is kept as
+// the job's output, except for the lines onLine reports it consumed, like
+// progress updates, and the last line of stderr is used to describe a
+// failure.
+func runCommand(ctx context.Context, onLine func(string) bool, name string, args ...string) error {
+	cmd := command(ctx, name, args...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+	appendOutput(ctx, "$ %s %s\n", name, strings.Join(args, " "))
+	exited, err := startCommand(ctx, cmd)
+	if err != nil {
+		return err
+	}
+	tr, _ := trace.FromContext(ctx)
+	scan := func(r io.Reader, onLine func(string) bool) (string, error) {
+		last := ""
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 64*1024), kMaxLineSize)
+		scanner.Split(scanLines)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if line == "" {
+				continue
+			}
+			last = line
+			if onLine == nil || !onLine(line) {
+				appendOutput(ctx, "%s\n", line)
+			}
+			if tr != nil {
+				tr.LazyPrintf("%s: %s", name, line)
+			}
+		}
+		// Keep the command from blocking on a full pipe.
+		io.Copy(ioutil.Discard, r)
+		return last, scanner.Err()
+	}
+	var wg sync.WaitGroup
+	var stdoutErr error
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, stdoutErr = scan(stdout, onLine)
+	}()
+	lastError, stderrErr := scan(stderr, nil)
+	wg.Wait()
+	err = cmd.Wait()
+	exited()
+	if err != nil {
+		return commandError(name, err, lastError)
+	}
+	if stdoutErr != nil {
+		return fmt.Errorf("Reading output of %s failed: %v", name, stdoutErr)
+	}
+	if stderrErr != nil {
+		return fmt.Errorf("Reading errors of %s failed: %v", name, stderrErr)
+	}
+	return nil
+}
+
+var youtubeDLProgress = regexp.MustCompile(`^\[download\]\s+([\d.]+)% of\s+\S+(?:\s+at\s+(\S+))?(?:\s+ETA\s+(\S+))?`)
+
+// youtubeDLProgressParser parses youtube-dl --newline output, consuming its
+// progress lines.
+func youtubeDLProgressParser(ctx context.Context) func(string) bool {
+	return func(line string) bool {
+		m := youtubeDLProgress.FindStringSubmatch(line)
+		if m == nil {
+			return false
+		}
+		percent, err := strconv.ParseFloat(m[1], 64)
+		if err != nil {
+			return false
+		}
+		SetProgress(ctx, Progress{
+			Percent: percent,
+			Speed:   m[2],
+			ETA:     m[3],
+		})
+		return true
+	}
+}
+
+// ffmpegProgressParser parses ffmpeg -progress output, for an output that is
+// expected to be total long. All of it is consumed, as it is of no use once
+// shown as progress.
+func ffmpegProgressParser(ctx context.Context, total time.Duration) func(string) bool {
+	var position time.Duration
+	var size int64
+	speed := 0.0
+	return func(line string) bool {
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return false
+		}
+		key, value := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		switch key {
+		case "out_time_us", "out_time_ms":
+			// Despite its name, out_time_ms is in microseconds too.
+			if us, err := strconv.ParseInt(value, 10, 64); err == nil {
+				position = time.Duration(us) * time.Microsecond
+			}
+		case "speed":
+			speed, _ = strconv.ParseFloat(strings.TrimSuffix(value, "x"), 64)
+		case "total_size":
+			size, _ = strconv.ParseInt(value, 10, 64)
+		case "progress":
+			p := Progress{Size: size}
+			if speed > 0 {
+				p.Speed = fmt.Sprintf("%.2fx", speed)
+			}
+			if value == "end" {
+				p.Percent = 100
+			} else if total > 0 {
+				p.Percent = 100 * position.Seconds() / total.Seconds()
+				if p.Percent > 100 {
+					p.Percent = 100
+				}
+				if speed > 0 && position < total {
+					eta := time.Duration(float64(total-position) / speed)
+					p.ETA = eta.Truncate(time.Second).String()
+				}
+			}
+			SetProgress(ctx, p)
+		}
+		return true
+	}
+}
@@ -0,0 +1,50 @@
+package work
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestRunCommandSplitsProgressLines(t *testing.T) {
+	lines := []string{}
+	if err := runCommand(context.Background(), func(line string) bool {
+		lines = append(lines, line)
+		return true
+	}, "sh", "-c", `printf 'a\rb\rc\n'`); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(lines, ",") != "a,b,c" {
+		t.Fatalf("Unexpected lines %q", lines)
+	}
+}
+
+func TestRunCommandLongLine(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	// A line over the limit, and more output than fits into a pipe after.
+	err := runCommand(ctx, nil, "sh", "-c",
+		`head -c 2000000 /dev/zero | tr '\0' x; echo; head -c 1000000 /dev/zero; head -c 1000000 /dev/zero >&2`)
+	if ctx.Err() != nil {
+		t.Fatal("Command got stuck.")
+	}
+	if err == nil || !strings.Contains(err.Error(), "too long") {
+		t.Fatalf("Expected a line too long, got %v", err)
+	}
+}
+
+func TestRunCommandKeepsUnconsumedOutput(t *testing.T) {
+	r := &WorkRequest{overlord: NewOverlord()}
+	ctx := context.WithValue(context.Background(), requestKey{}, r)
+	if err := runCommand(ctx, func(line string) bool {
+		return strings.HasPrefix(line, "progress=")
+	}, "sh", "-c", `echo progress=continue; echo hello; echo progress=end`); err != nil {
+		t.Fatal(err)
+	}
+	output := r.output.String()
+	if strings.Contains(output, "\nprogress=") || !strings.Contains(output, "\nhello\n") {
+		t.Fatalf("Unexpected output %q", output)
+	}
+}
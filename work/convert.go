@@ -0,0 +1,123 @@
+package work
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/trace"
+)
+
+// Filters rendering audio into video, for sources without a video stream,
+// given the width, height and frame rate to render at.
+var visualizers = map[string]string{
+	"spectrum": "showfreqs=s=%[1]dx%[2]d:mode=bar:fscale=log:ascale=log,fps=%[3]d,format=yuv420p",
+	"waveform": "showwaves=s=%[1]dx%[2]d:mode=cline:rate=%[3]d,format=yuv420p",
+}
+
+func IsVisualizer(name string) bool {
+	_, ok := visualizers[name]
+	return ok
+}
+
+// convertHandler converts params["source"] into a webm at params["target"],
+// according to the Profile in params. Cropping follows the analysis at
+// params["crop_analysis"], if any, see analyzeCropHandler, and audio is
+// normalized to the Loudness at params["loudness"], if any. Sources without
+// video get params["visualizer"] rendered instead.
+type convertHandler struct{}
+
+func init() {
+	registerBuiltin(convertHandler{})
+}
+
+func (convertHandler) Name() string {
+	return "convert"
+}
+
+func (convertHandler) Run(ctx context.Context, params Params) error {
+	profile, err := profileFromParams(params)
+	if err != nil {
+		return err
+	}
+	p, err := probe(ctx, params["source"])
+	if err != nil {
+		return err
+	}
+	args := []string{
+		// Overwrite what an earlier, failed attempt left behind.
+		"-y",
+		"-progress", "pipe:1", "-nostats",
+		"-i", params["source"],
+	}
+	if p.HasVideo {
+		filter := profile.scaleFilter()
+		if profile.Mode == "crop" && params["crop_analysis"] != "" {
+			if a, err := loadCropAnalysis(params["crop_analysis"]); err == nil {
+				filter = profile.panFilter(a)
+			} else if tr, ok := trace.FromContext(ctx); ok {
+				tr.LazyPrintf("No crop analysis, cropping at the center: %v", err)
+			}
+		}
+		if profile.FPS != 0 {
+			filter += fmt.Sprintf(",fps=%d", profile.FPS)
+		}
+		args = append(args,
+			"-vf", filter,
+		)
+	} else if p.HasAudio {
+		filter, ok := visualizers[params["visualizer"]]
+		if !ok {
+			return fmt.Errorf("Unknown visualizer %q.", params["visualizer"])
+		}
+		if tr, ok := trace.FromContext(ctx); ok {
+			tr.LazyPrintf("No video stream, rendering %s visualization.", params["visualizer"])
+		}
+		filter = fmt.Sprintf(filter, profile.Width, profile.Height, profile.fps())
+		args = append(args,
+			"-filter_complex", fmt.Sprintf("[0:a]%s[v]", filter),
+			"-map", "[v]", "-map", "0:a",
+		)
+	} else {
+		return errors.New("Source has neither video nor audio.")
+	}
+	args = append(args, "-c:v", profile.VideoCodec, "-b:v", profile.VideoBitrate)
+	if profile.Audio {
+		if params["loudness"] != "" {
+			if l, err := LoadLoudness(params["loudness"]); err == nil {
+				// loudnorm resamples to 192kHz, so resample back.
+				args = append(args, "-af", l.filter(), "-ar", "48000")
+			} else if tr, ok := trace.FromContext(ctx); ok {
+				tr.LazyPrintf("No loudness measurement, not normalizing: %v", err)
+			}
+		}
+		args = append(args, "-c:a", profile.AudioCodec)
+	} else {
+		args = append(args, "-an")
+	}
+	args = append(args,
+		// Write a stream that can be played while it is being written,
+		// without seeking back to fill in the index at the end.
+		"-f", "webm", "-live", "1",
+		params["target"],
+	)
+	if tr, ok := trace.FromContext(ctx); ok {
+		tr.LazyPrintf("Starting ffmpeg %v...", args)
+	}
+	err = runCommand(ctx, ffmpegProgressParser(ctx, p.Duration), "ffmpeg", args...)
+	if err != nil {
+		// Nobody should mistake a partial conversion for a rendition.
+		os.Remove(params["target"])
+	}
+	return err
+}
+
+func (convertHandler) Timeout() time.Duration {
+	return 2 * time.Hour
+}
+
+func (convertHandler) Describe(params Params) string {
+	return fmt.Sprintf("Converting (%s -> %s, %s)", params["source"], params["target"], params["profile"])
+}
@@ -0,0 +1,51 @@
+package work
+
+import (
+	"fmt"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/trace"
+)
+
+// webDownloadHandler downloads params["url"] to params["target"] with
+// youtube-dl.
+type webDownloadHandler struct{}
+
+func init() {
+	registerBuiltin(webDownloadHandler{})
+}
+
+func (webDownloadHandler) Name() string {
+	return "web_download"
+}
+
+func (webDownloadHandler) Run(ctx context.Context, params Params) error {
+	tmpTargetPath := fmt.Sprintf("%s.temporary", params["target"])
+	execCmd := fmt.Sprintf("mv {} %s", params["target"])
+	args := []string{
+		params["url"],
+		"--max-downloads=1",
+		"--newline",
+		"-o", tmpTargetPath,
+		"--exec", execCmd,
+	}
+	if tr, ok := trace.FromContext(ctx); ok {
+		tr.LazyPrintf("Starting download %v...", args)
+	}
+	// A partial download left behind by a failure is resumed by the next
+	// attempt, and removed by the chain once there are none left.
+	return runCommand(ctx, youtubeDLProgressParser(ctx), "youtube-dl", args...)
+}
+
+func (webDownloadHandler) RetryPolicy() RetryPolicy {
+	return networkRetryPolicy
+}
+
+func (webDownloadHandler) Timeout() time.Duration {
+	return 30 * time.Minute
+}
+
+func (webDownloadHandler) Describe(params Params) string {
+	return fmt.Sprintf("Downloading (%s -> %s)", params["url"], params["target"])
+}
@@ -0,0 +1,92 @@
+package work
+
+import (
+	"fmt"
+)
+
+const (
+	// Events buffered per subscriber. Progress events are dropped rather than
+	// block a job when a subscriber falls behind.
+	kEventBuffer = 16
+)
+
+// Event tells subscribers about the progress or completion of a request.
+type Event struct {
+	UID      int64
+	Progress Progress
+	// Set on the last event of a request.
+	Done    bool
+	Success bool
+	Error   *JobError
+}
+
+func (r *WorkRequest) event() Event {
+	return Event{
+		UID:      r.UID,
+		Progress: r.progress,
+		Done:     r.Done,
+		Success:  r.Success,
+		Error:    r.LastError,
+	}
+}
+
+// Subscribe returns a channel of events of a request, which gets closed after
+// the request is done. The returned function stops the subscription early.
+func (o *Overlord) Subscribe(uid int64) (<-chan Event, func(), error) {
+	o.mutex.RLock()
+	defer o.mutex.RUnlock()
+	r := o.workDirectory[uid]
+	if r == nil {
+		return nil, nil, fmt.Errorf("No such work %d.", uid)
+	}
+
+	r.progressMutex.Lock()
+	defer r.progressMutex.Unlock()
+	c := make(chan Event, kEventBuffer)
+	if r.Done {
+		c <- r.event()
+		close(c)
+		return c, func() {}, nil
+	}
+	r.subscribers = append(r.subscribers, c)
+	unsubscribe := func() {
+		r.progressMutex.Lock()
+		defer r.progressMutex.Unlock()
+		for i, s := range r.subscribers {
+			if s == c {
+				r.subscribers = append(r.subscribers[:i], r.subscribers[i+1:]...)
+				close(c)
+				return
+			}
+		}
+	}
+	return c, unsubscribe, nil
+}
+
+// publishProgress tells subscribers about progress. Called with the progress
+// mutex held.
+func (r *WorkRequest) publishProgress() {
+	ev := r.event()
+	for _, c := range r.subscribers {
+		select {
+		case c <- ev:
+		default:
+		}
+	}
+}
+
+// publishDone sends the last event to every subscriber and closes their
+// channels. Called once the request is done.
+func (r *WorkRequest) publishDone() {
+	r.progressMutex.Lock()
+	defer r.progressMutex.Unlock()
+	ev := r.event()
+	for _, c := range r.subscribers {
+		// Unlike progress, this one must not get lost.
+		go func(c chan Event) {
+			c <- ev
+			close(c)
+		}(c)
+	}
+	r.subscribers = nil
+}
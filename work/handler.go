@@ -0,0 +1,60 @@
+package work
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+// Params are the parameters of a job, as interpreted by its handler.
+type Params map[string]string
+
+// JobHandler implements a kind of job. Handlers are registered with the
+// Overlord under their name, which requests then refer to as their type.
+type JobHandler interface {
+	// Name of the kind of job, eg. "convert".
+	Name() string
+	// Run does the job. The context is cancelled when the job is, and can be
+	// used to report progress with SetProgress.
+	Run(ctx context.Context, params Params) error
+	// Describe returns a human readable description of a job.
+	Describe(params Params) string
+}
+
+// Handlers for the job types built into webled, registered with every
+// Overlord.
+var builtinHandlers = []JobHandler{}
+
+func registerBuiltin(h JobHandler) {
+	builtinHandlers = append(builtinHandlers, h)
+}
+
+// RegisterHandler makes a kind of job available, replacing any handler
+// registered under the same name.
+func (o *Overlord) RegisterHandler(h JobHandler) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.handlers[h.Name()] = h
+}
+
+func (o *Overlord) handler(name string) JobHandler {
+	o.mutex.RLock()
+	defer o.mutex.RUnlock()
+	return o.handlers[name]
+}
+
+// describeParams is a fallback description for jobs of unknown type.
+func describeParams(name string, params Params) string {
+	keys := []string{}
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := []string{}
+	for _, k := range keys {
+		parts = append(parts, fmt.Sprintf("%s=%s", k, params[k]))
+	}
+	return fmt.Sprintf("%s(%s)", name, strings.Join(parts, ", "))
+}
@@ -0,0 +1,75 @@
+package work
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/trace"
+)
+
+const (
+	kMaxImageSize = 32 * 1024 * 1024
+)
+
+// httpDownloadHandler fetches params["url"] into params["target"], up to
+// kMaxImageSize bytes.
+type httpDownloadHandler struct{}
+
+func init() {
+	registerBuiltin(httpDownloadHandler{})
+}
+
+func (httpDownloadHandler) Name() string {
+	return "http_download"
+}
+
+func (httpDownloadHandler) Run(ctx context.Context, params Params) error {
+	if tr, ok := trace.FromContext(ctx); ok {
+		tr.LazyPrintf("Fetching %s...", params["url"])
+	}
+	req, err := http.NewRequest("GET", params["url"], nil)
+	if err != nil {
+		return err
+	}
+	res, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("Server returned %s.", res.Status)
+	}
+	f, err := os.Create(params["target"])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	n, err := io.Copy(io.MultiWriter(f, &progressWriter{ctx: ctx, total: res.ContentLength}), io.LimitReader(res.Body, kMaxImageSize+1))
+	if err != nil {
+		return err
+	}
+	if n > kMaxImageSize {
+		return errors.New("File too large.")
+	}
+	if tr, ok := trace.FromContext(ctx); ok {
+		tr.LazyPrintf("Fetched %d bytes.", n)
+	}
+	return nil
+}
+
+func (httpDownloadHandler) RetryPolicy() RetryPolicy {
+	return networkRetryPolicy
+}
+
+func (httpDownloadHandler) Timeout() time.Duration {
+	return 5 * time.Minute
+}
+
+func (httpDownloadHandler) Describe(params Params) string {
+	return fmt.Sprintf("Fetching (%s -> %s)", params["url"], params["target"])
+}
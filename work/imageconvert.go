@@ -0,0 +1,100 @@
+package work
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/trace"
+)
+
+// sniffImage returns the MIME type of a downloaded image, failing for
+// anything that is not a PNG, JPEG or GIF.
+func sniffImage(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	header := make([]byte, 512)
+	n, err := f.Read(header)
+	if err != nil {
+		return "", err
+	}
+	mime := http.DetectContentType(header[:n])
+	switch mime {
+	case "image/png", "image/jpeg", "image/gif":
+		return mime, nil
+	}
+	return "", fmt.Errorf("Unsupported image type %s.", mime)
+}
+
+// imageConvertHandler turns the image at params["source"] into a video of
+// params["duration"] at params["target"], according to the Profile in params.
+type imageConvertHandler struct{}
+
+func init() {
+	registerBuiltin(imageConvertHandler{})
+}
+
+func (imageConvertHandler) Name() string {
+	return "image_convert"
+}
+
+func (imageConvertHandler) Run(ctx context.Context, params Params) error {
+	duration, err := time.ParseDuration(params["duration"])
+	if err != nil {
+		return err
+	}
+	profile, err := profileFromParams(params)
+	if err != nil {
+		return err
+	}
+	mime, err := sniffImage(params["source"])
+	if err != nil {
+		return err
+	}
+	// Overwrite what an earlier, failed attempt left behind.
+	args := []string{"-y", "-progress", "pipe:1", "-nostats"}
+	filter := profile.scaleFilter() + ",format=yuv420p"
+	if mime == "image/gif" {
+		// Play GIFs as many times as they say they should be, which is
+		// forever for most animations, and hold their last frame for the
+		// rest of the duration, as still GIFs and those looping a few times
+		// only would end early.
+		args = append(args, "-ignore_loop", "0")
+		filter = fmt.Sprintf("tpad=stop_mode=clone:stop_duration=%.3f,%s", duration.Seconds(), filter)
+	} else {
+		args = append(args, "-loop", "1")
+	}
+	args = append(args,
+		"-i", params["source"],
+		"-t", fmt.Sprintf("%.3f", duration.Seconds()),
+		"-vf", filter,
+		"-r", strconv.Itoa(profile.fps()),
+		"-c:v", profile.VideoCodec, "-b:v", profile.VideoBitrate,
+		"-an",
+		"-f", "webm",
+		params["target"],
+	)
+	if tr, ok := trace.FromContext(ctx); ok {
+		tr.LazyPrintf("Starting ffmpeg %v...", args)
+	}
+	err = runCommand(ctx, ffmpegProgressParser(ctx, duration), "ffmpeg", args...)
+	if err != nil {
+		// Nobody should mistake a partial conversion for a rendition.
+		os.Remove(params["target"])
+	}
+	return err
+}
+
+func (imageConvertHandler) Timeout() time.Duration {
+	return 10 * time.Minute
+}
+
+func (imageConvertHandler) Describe(params Params) string {
+	return fmt.Sprintf("Converting image (%s -> %s, %s, %s)", params["source"], params["target"], params["duration"], params["profile"])
+}
@@ -0,0 +1,45 @@
+package work
+
+import (
+	"image"
+	"image/color"
+	"image/gif"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestImageConvertSingleFrameGIF(t *testing.T) {
+	if _, err := exec.LookPath("ffmpeg"); err != nil {
+		t.Skip("No ffmpeg.")
+	}
+	dir := t.TempDir()
+	source := filepath.Join(dir, "still.gif")
+	target := filepath.Join(dir, "still.webm")
+	f, err := os.Create(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame := image.NewPaletted(image.Rect(0, 0, 16, 16), color.Palette{color.Black, color.White})
+	err = gif.EncodeAll(f, &gif.GIF{Image: []*image.Paletted{frame}, Delay: []int{10}})
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	params := defaultProfile.params(Params{"source": source, "target": target, "duration": "3s"})
+	if err := (imageConvertHandler{}).Run(context.Background(), params); err != nil {
+		t.Fatal(err)
+	}
+	p, err := probe(context.Background(), target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := p.Duration; d < 2900*time.Millisecond || d > 3100*time.Millisecond {
+		t.Fatalf("Expected a 3s video, got %v", d)
+	}
+}
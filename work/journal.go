@@ -0,0 +1,217 @@
+package work
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	"golang.org/x/net/trace"
+)
+
+const (
+	kDefaultJournalRetention = 7 * 24 * time.Hour
+)
+
+// journalRecord is what the journal keeps about a request, one JSON file per
+// request.
+type journalRecord struct {
+	UID       int64     `json:"uid"`
+	Type      string    `json:"type"`
+	Priority  Priority  `json:"priority"`
+	Params    Params    `json:"params"`
+	Depends   []int64   `json:"depends"`
+	AlwaysRun bool      `json:"always_run"`
+	Done      bool      `json:"done"`
+	Success   bool      `json:"success"`
+	Cancelled bool      `json:"cancelled"`
+	Attempts  int       `json:"attempts"`
+	LastError *JobError `json:"last_error"`
+	Created   time.Time `json:"created"`
+	Finished  time.Time `json:"finished"`
+}
+
+func (o *Overlord) journalPath(uid int64) string {
+	return filepath.Join(o.journalDirectory, fmt.Sprintf("%d.json", uid))
+}
+
+// journal saves the state of a request, if journaling is enabled. Called with
+// the mutex held.
+func (o *Overlord) journal(r *WorkRequest) {
+	if o.journalDirectory == "" {
+		return
+	}
+	rec := journalRecord{
+		UID:       r.UID,
+		Type:      r.Type,
+		Priority:  r.Priority,
+		Params:    r.Params,
+		Depends:   []int64{},
+		AlwaysRun: r.AlwaysRun,
+		Done:      r.Done,
+		Success:   r.Success,
+		Cancelled: r.Cancelled,
+		Attempts:  r.Attempts,
+		LastError: r.LastError,
+		Created:   r.Created,
+		Finished:  r.Finished,
+	}
+	for _, d := range r.Depends {
+		rec.Depends = append(rec.Depends, d.UID)
+	}
+	data, err := json.Marshal(&rec)
+	if err != nil {
+		glog.Warningf("Could not journal work %d: %v", r.UID, err)
+		return
+	}
+	// Write and rename, so that a crash never leaves a truncated record.
+	path := o.journalPath(r.UID)
+	if err := ioutil.WriteFile(path+".tmp", data, 0644); err != nil {
+		glog.Warningf("Could not journal work %d: %v", r.UID, err)
+		return
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		glog.Warningf("Could not journal work %d: %v", r.UID, err)
+	}
+}
+
+// prune forgets requests that finished longer than JournalRetention ago and
+// that nothing unfinished depends on. Called with the mutex held.
+func (o *Overlord) prune(now time.Time) {
+	for uid, r := range o.workDirectory {
+		if !r.Done || now.Sub(r.Finished) < o.JournalRetention {
+			continue
+		}
+		needed := false
+		for _, d := range r.dependents {
+			if !d.Done {
+				needed = true
+			}
+		}
+		if needed {
+			continue
+		}
+		delete(o.workDirectory, uid)
+		if o.journalDirectory != "" {
+			os.Remove(o.journalPath(uid))
+			os.Remove(o.outputPath(uid))
+		}
+	}
+}
+
+// OpenJournal starts journaling requests to dir, after loading the requests
+// journaled there before. Finished ones are kept for inspection, unfinished
+// ones are scheduled again. Requests that cannot run anymore are marked as
+// failed, which in turn runs the cleanup requests depending on them.
+func (o *Overlord) OpenJournal(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	records := []*journalRecord{}
+	for _, f := range files {
+		name := filepath.Join(dir, f.Name())
+		if strings.HasSuffix(f.Name(), ".tmp") {
+			os.Remove(name)
+			continue
+		}
+		if !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		// Records from before priorities existed are normal ones.
+		rec := &journalRecord{Priority: PRIORITY_NORMAL}
+		if err := json.Unmarshal(data, rec); err != nil {
+			glog.Warningf("Ignoring corrupt journal record %s: %v", name, err)
+			continue
+		}
+		records = append(records, rec)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].UID < records[j].UID
+	})
+
+	o.mutex.Lock()
+	o.journalDirectory = dir
+	loaded := make(map[int64]*WorkRequest)
+	pending := []*WorkRequest{}
+	for _, rec := range records {
+		ctx, cancel := context.WithCancel(context.Background())
+		r := &WorkRequest{
+			Type:       rec.Type,
+			Priority:   rec.Priority,
+			readyIndex: -1,
+			Params:     rec.Params,
+			UID:        rec.UID,
+			overlord:   o,
+			handler:    o.handlers[rec.Type],
+			context:    trace.NewContext(ctx, trace.New("webled.work", describeParams(rec.Type, rec.Params))),
+			cancel:     cancel,
+			AlwaysRun:  rec.AlwaysRun,
+			Done:       rec.Done,
+			Success:    rec.Success,
+			Cancelled:  rec.Cancelled,
+			Attempts:   rec.Attempts,
+			LastError:  rec.LastError,
+			Created:    rec.Created,
+			Finished:   rec.Finished,
+		}
+		if r.Params == nil {
+			r.Params = Params{}
+		}
+		if rec.UID >= o.currentUID {
+			o.currentUID = rec.UID + 1
+		}
+		missing := false
+		for _, uid := range rec.Depends {
+			d, ok := loaded[uid]
+			if !ok {
+				missing = true
+				continue
+			}
+			r.Depends = append(r.Depends, d)
+			// Submit takes care of dependencies that are not done yet.
+			if d.Done && !r.Done {
+				d.dependents = append(d.dependents, r)
+			}
+		}
+		loaded[r.UID] = r
+		o.workDirectory[r.UID] = r
+
+		if r.Done {
+			r.cancel()
+			if tr, ok := trace.FromContext(r.context); ok {
+				tr.Finish()
+			}
+			continue
+		}
+		switch {
+		case missing:
+			glog.Warningf("Work %d depends on forgotten work, failing it.", r.UID)
+		case r.handler == nil:
+			glog.Warningf("Work %d has unknown type %q, failing it.", r.UID, r.Type)
+		case r.Cancelled:
+		default:
+			glog.Infof("Resuming work %d: %s", r.UID, r.Description())
+			pending = append(pending, r)
+			continue
+		}
+		o.finish(r, false)
+	}
+	o.prune(time.Now())
+	o.mutex.Unlock()
+
+	return o.Submit(pending...)
+}
@@ -0,0 +1,67 @@
+package work
+
+import (
+	"golang.org/x/net/context"
+	"os/exec"
+	"time"
+)
+
+// Limits constrain the commands spawned by jobs. Zero values leave things
+// as they are. Only supported on Linux.
+type Limits struct {
+	// CPU niceness, see nice(1). Zero values leave things unchanged.
+	Nice int
+	// I/O scheduling class (1 realtime, 2 best-effort, 3 idle) and priority
+	// within it, see ionice(1).
+	IOClass    int
+	IOPriority int
+	// Maximum address space in bytes, see prlimit(1).
+	Memory uint64
+}
+
+// TimeLimited is implemented by JobHandlers whose jobs should be given up on
+// after a while, eg. because the tools they run are known to hang.
+type TimeLimited interface {
+	Timeout() time.Duration
+}
+
+// jobTimeout returns how long a request may run, or zero if forever. Called
+// with the mutex held.
+func (o *Overlord) jobTimeout(r *WorkRequest) time.Duration {
+	if t, ok := o.Timeouts[r.Type]; ok {
+		return t
+	}
+	if l, ok := r.handler.(TimeLimited); ok {
+		return l.Timeout()
+	}
+	return 0
+}
+
+// command prepares a command to be run by the job run with ctx, in its own
+// process group and with the Overlord's Limits applied.
+func command(ctx context.Context, name string, args ...string) *exec.Cmd {
+	if r, ok := ctx.Value(requestKey{}).(*WorkRequest); ok {
+		name, args = limitCommand(r.overlord.Limits, name, args)
+	}
+	cmd := exec.Command(name, args...)
+	setProcessGroup(cmd)
+	return cmd
+}
+
+// startCommand starts a command prepared by command, and kills its whole
+// process group once ctx is done. The returned function must be called after
+// the command exits.
+func startCommand(ctx context.Context, cmd *exec.Cmd) (func(), error) {
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	exited := make(chan bool)
+	go func() {
+		select {
+		case <-ctx.Done():
+			killProcessGroup(cmd.Process)
+		case <-exited:
+		}
+	}()
+	return func() { close(exited) }, nil
+}
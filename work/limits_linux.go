@@ -0,0 +1,50 @@
+//go:build linux
+// +build linux
+
+package work
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+)
+
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// killProcessGroup kills a process started by startCommand along with
+// everything it spawned, like the ffmpeg run by youtube-dl.
+func killProcessGroup(p *os.Process) {
+	syscall.Kill(-p.Pid, syscall.SIGKILL)
+}
+
+// limitCommand wraps a command in nice(1), ionice(1) and prlimit(1) as
+// needed, which apply the limits before the command gets to run or spawn
+// anything. Go cannot set rlimits in the child between fork and exec, and
+// setting them after the command started races with what it spawns, so
+// memory limits need prlimit from util-linux to be installed.
+func limitCommand(l Limits, name string, args []string) (string, []string) {
+	argv := []string{}
+	if l.Nice != 0 {
+		argv = append(argv, "nice", "-n", strconv.Itoa(l.Nice))
+	}
+	if l.IOClass != 0 {
+		argv = append(argv, "ionice", "-c", strconv.Itoa(l.IOClass))
+		// The idle class has no priorities.
+		if l.IOClass != 3 {
+			argv = append(argv, "-n", strconv.Itoa(l.IOPriority))
+		}
+	}
+	if l.Memory != 0 {
+		argv = append(argv, "prlimit", fmt.Sprintf("--as=%d", l.Memory), "--")
+	}
+	if len(argv) == 0 {
+		return name, args
+	}
+	argv = append(argv, name)
+	argv = append(argv, args...)
+	return argv[0], argv[1:]
+}
@@ -0,0 +1,22 @@
+//go:build !linux
+// +build !linux
+
+package work
+
+import (
+	"os"
+	"os/exec"
+)
+
+func setProcessGroup(cmd *exec.Cmd) {
+}
+
+// killProcessGroup can only kill the process itself here.
+func killProcessGroup(p *os.Process) {
+	p.Kill()
+}
+
+// limitCommand ignores the limits, which are only supported on Linux.
+func limitCommand(l Limits, name string, args []string) (string, []string) {
+	return name, args
+}
@@ -0,0 +1,174 @@
+package work
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	"golang.org/x/net/trace"
+)
+
+const (
+	// Integrated loudness in LUFS, true peak in dBTP and loudness range in
+	// LU that audio is normalized to.
+	kLoudnessTarget = -16
+	kTruePeakTarget = -1.5
+	kLoudnessRange  = 11
+)
+
+// Loudness of a video as measured by the first pass of ffmpeg's loudnorm.
+type Loudness struct {
+	Integrated float64 `json:"integrated"`
+	TruePeak   float64 `json:"true_peak"`
+	Range      float64 `json:"range"`
+	Threshold  float64 `json:"threshold"`
+	Offset     float64 `json:"offset"`
+}
+
+// LoadLoudness reads a Loudness written by a measure_loudness job.
+func LoadLoudness(path string) (*Loudness, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	l := &Loudness{}
+	if err := json.Unmarshal(data, l); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// filter returns the second pass of loudnorm, normalizing audio of this
+// loudness.
+func (l *Loudness) filter() string {
+	return fmt.Sprintf("loudnorm=I=%d:TP=%.1f:LRA=%d:measured_I=%.2f:measured_TP=%.2f:measured_LRA=%.2f:measured_thresh=%.2f:offset=%.2f:linear=true",
+		kLoudnessTarget, kTruePeakTarget, kLoudnessRange,
+		l.Integrated, l.TruePeak, l.Range, l.Threshold, l.Offset)
+}
+
+// See ffmpeg-filters(1) loudnorm print_format=json.
+type loudnormOutput struct {
+	InputI       string `json:"input_i"`
+	InputTP      string `json:"input_tp"`
+	InputLRA     string `json:"input_lra"`
+	InputThresh  string `json:"input_thresh"`
+	TargetOffset string `json:"target_offset"`
+}
+
+// measureLoudnessHandler measures the loudness of the audio at
+// params["source"], writing a Loudness as JSON to params["target"] for
+// convertHandler to normalize with. Like analyzeCropHandler it is best
+// effort: if there is nothing to measure or measuring fails, nothing is
+// written and audio is converted as is.
+type measureLoudnessHandler struct{}
+
+func init() {
+	registerBuiltin(measureLoudnessHandler{})
+}
+
+func (measureLoudnessHandler) Name() string {
+	return "measure_loudness"
+}
+
+func (measureLoudnessHandler) Run(ctx context.Context, params Params) error {
+	l, err := measureLoudness(ctx, params["source"])
+	if err == nil && l != nil {
+		var data []byte
+		if data, err = json.Marshal(l); err == nil {
+			err = ioutil.WriteFile(params["target"], data, 0644)
+		}
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return err
+		}
+		glog.Warningf("Could not measure loudness of %s, not normalizing: %v", params["source"], err)
+		appendOutput(ctx, "Measurement failed, not normalizing: %v\n", err)
+		return nil
+	}
+	if tr, ok := trace.FromContext(ctx); ok {
+		tr.LazyPrintf("Loudness %+v.", l)
+	}
+	return nil
+}
+
+func (measureLoudnessHandler) Timeout() time.Duration {
+	return 30 * time.Minute
+}
+
+func (measureLoudnessHandler) Describe(params Params) string {
+	return "Measuring loudness of " + params["source"]
+}
+
+// measureLoudness runs the first pass of loudnorm over a file, returning nil
+// if it has no audio or only silence.
+func measureLoudness(ctx context.Context, source string) (*Loudness, error) {
+	p, err := probe(ctx, source)
+	if err != nil {
+		return nil, err
+	}
+	if !p.HasAudio {
+		return nil, nil
+	}
+	filter := fmt.Sprintf("loudnorm=I=%d:TP=%.1f:LRA=%d:print_format=json", kLoudnessTarget, kTruePeakTarget, kLoudnessRange)
+	cmd := command(ctx, "ffmpeg", "-nostats", "-hide_banner",
+		"-i", source,
+		"-vn",
+		"-af", filter,
+		"-f", "null", "-",
+	)
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	exited, err := startCommand(ctx, cmd)
+	if err != nil {
+		return nil, err
+	}
+	err = cmd.Wait()
+	exited()
+	out := stderr.String()
+	if err != nil {
+		appendOutput(ctx, "$ ffmpeg %s\n%s", filter, out)
+		lines := strings.Split(strings.TrimSpace(out), "\n")
+		return nil, commandError("ffmpeg", err, lines[len(lines)-1])
+	}
+	// The measurement is printed last, after the usual logging.
+	start := strings.LastIndex(out, "{")
+	end := strings.LastIndex(out, "}")
+	if start < 0 || end < start {
+		return nil, errors.New("No loudness measurement in ffmpeg output.")
+	}
+	o := loudnormOutput{}
+	if err := json.Unmarshal([]byte(out[start:end+1]), &o); err != nil {
+		return nil, err
+	}
+	l := &Loudness{}
+	for _, f := range []struct {
+		value string
+		into  *float64
+	}{
+		{o.InputI, &l.Integrated},
+		{o.InputTP, &l.TruePeak},
+		{o.InputLRA, &l.Range},
+		{o.InputThresh, &l.Threshold},
+		{o.TargetOffset, &l.Offset},
+	} {
+		v, err := strconv.ParseFloat(f.value, 64)
+		if err != nil {
+			return nil, err
+		}
+		if math.IsInf(v, 0) || math.IsNaN(v) {
+			// Silence, nothing to normalize.
+			return nil, nil
+		}
+		*f.into = v
+	}
+	return l, nil
+}
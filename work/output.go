@@ -0,0 +1,140 @@
+package work
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"syscall"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+)
+
+const (
+	// How much of the output of its commands is kept per job.
+	kOutputSize = 64 * 1024
+)
+
+// outputBuffer keeps the tail of everything written to it.
+type outputBuffer struct {
+	mutex sync.Mutex
+	data  []byte
+}
+
+func (b *outputBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.data = append(b.data, p...)
+	if len(b.data) > kOutputSize {
+		b.data = append([]byte{}, b.data[len(b.data)-kOutputSize:]...)
+	}
+	return len(p), nil
+}
+
+// Reset empties the buffer, releasing its memory.
+func (b *outputBuffer) Reset() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.data = nil
+}
+
+func (b *outputBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return string(b.data)
+}
+
+// appendOutput adds to the output of the job run with ctx, if any.
+func appendOutput(ctx context.Context, format string, args ...interface{}) {
+	if r, ok := ctx.Value(requestKey{}).(*WorkRequest); ok {
+		fmt.Fprintf(&r.output, format, args...)
+	}
+}
+
+// JobError describes why a job failed.
+type JobError struct {
+	Message string `json:"message"`
+	// Set if the job failed because a command did.
+	Command  string `json:"command,omitempty"`
+	ExitCode int    `json:"exit_code,omitempty"`
+}
+
+func (e *JobError) Error() string {
+	return e.Message
+}
+
+// commandError describes a failed command, using the last line it wrote to
+// stderr as the message if there was one.
+func commandError(name string, err error, lastLine string) *JobError {
+	e := &JobError{
+		Message: fmt.Sprintf("%s failed: %v", name, err),
+		Command: name,
+	}
+	if exit, ok := err.(*exec.ExitError); ok {
+		if status, ok := exit.Sys().(syscall.WaitStatus); ok {
+			e.ExitCode = status.ExitStatus()
+		}
+	}
+	if lastLine != "" {
+		e.Message = fmt.Sprintf("%s failed: %s", name, lastLine)
+	}
+	return e
+}
+
+// jobError turns whatever a handler returned into a JobError.
+func jobError(err error) *JobError {
+	if e, ok := err.(*JobError); ok {
+		return e
+	}
+	return &JobError{Message: err.Error()}
+}
+
+func (o *Overlord) outputPath(uid int64) string {
+	return filepath.Join(o.journalDirectory, fmt.Sprintf("%d.log", uid))
+}
+
+// saveOutput journals the output of a finished request, which from then on is
+// only kept on disk. Called with the mutex held.
+func (o *Overlord) saveOutput(r *WorkRequest) {
+	if o.journalDirectory == "" {
+		return
+	}
+	output := r.output.String()
+	if output == "" {
+		return
+	}
+	if err := ioutil.WriteFile(o.outputPath(r.UID), []byte(output), 0644); err != nil {
+		glog.Warningf("Could not save output of work %d: %v", r.UID, err)
+		return
+	}
+	r.output.Reset()
+}
+
+// GetWorkOutput returns the tail of the output of the commands run by a
+// request.
+func (o *Overlord) GetWorkOutput(uid int64) (string, error) {
+	o.mutex.RLock()
+	defer o.mutex.RUnlock()
+	r := o.workDirectory[uid]
+	if r == nil {
+		return "", fmt.Errorf("No such work %d.", uid)
+	}
+	if output := r.output.String(); output != "" || o.journalDirectory == "" {
+		return output, nil
+	}
+	// Requests loaded from the journal only have their output on disk.
+	data, err := ioutil.ReadFile(o.outputPath(uid))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	return string(data), err
+}
+
+// WorkOutput is GetWorkOutput for templates, which cannot deal with errors.
+func (o *Overlord) WorkOutput(uid int64) string {
+	output, _ := o.GetWorkOutput(uid)
+	return output
+}
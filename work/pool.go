@@ -0,0 +1,192 @@
+package work
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+const (
+	// Name of the pool running job types that have no pool of their own.
+	kDefaultPool = "default"
+)
+
+// workerPool is a set of workers running jobs of some types, along with the
+// requests waiting for them.
+type workerPool struct {
+	name    string
+	workers []*Worker
+	idle    []*Worker
+	ready   readyQueue
+	// Number of workers the pool should shrink to as they finish their jobs.
+	size int
+}
+
+// PoolStatus describes a worker pool, for the JSON API.
+type PoolStatus struct {
+	Name    string `json:"name"`
+	Size    int    `json:"size"`
+	Workers int    `json:"workers"`
+	Busy    int    `json:"busy"`
+	Queued  int    `json:"queued"`
+}
+
+// poolFor returns the pool running jobs of the given type: the pool named
+// after the type if it has workers, the default pool otherwise. Called with
+// the mutex held.
+func (o *Overlord) poolFor(t string) *workerPool {
+	if p, ok := o.pools[t]; ok && p.size > 0 {
+		return p
+	}
+	return o.pool(kDefaultPool)
+}
+
+// pool returns the named pool, creating an empty one if needed. Called with
+// the mutex held.
+func (o *Overlord) pool(name string) *workerPool {
+	if p, ok := o.pools[name]; ok {
+		return p
+	}
+	p := &workerPool{name: name, ready: readyQueue{}}
+	o.pools[name] = p
+	return p
+}
+
+// moveQueued moves requests queued in one pool to another, only those of
+// type t unless it is empty. Called with the mutex held.
+func (o *Overlord) moveQueued(from, to *workerPool, t string) {
+	keep := readyQueue{}
+	for _, r := range from.ready {
+		if t == "" || r.Type == t {
+			r.pool = to
+			heap.Push(&to.ready, r)
+		} else {
+			keep = append(keep, r)
+		}
+	}
+	for i, r := range keep {
+		r.readyIndex = i
+	}
+	from.ready = keep
+	heap.Init(&from.ready)
+}
+
+// Resize grows or shrinks a pool of workers. Pools other than "default" are
+// named after the job type they run, and are created as needed. Shrinking
+// retires idle workers right away and busy ones after their current job. A
+// pool shrunk to no workers hands its type back to the default pool, which
+// must keep at least one worker.
+func (o *Overlord) Resize(name string, size int) error {
+	if name == "" {
+		name = kDefaultPool
+	}
+	if size < 0 {
+		return fmt.Errorf("Invalid pool size %d.", size)
+	}
+	if name == kDefaultPool && size < 1 {
+		return errors.New("The default pool needs at least one worker.")
+	}
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if name != kDefaultPool && o.handlers[name] == nil {
+		return fmt.Errorf("Unknown job type %q.", name)
+	}
+	total := 0
+	for _, p := range o.pools {
+		total += len(p.workers)
+	}
+	p := o.pool(name)
+	if total-len(p.workers)+size > kMaxWorkers {
+		return fmt.Errorf("Too many workers, at most %d are allowed.", kMaxWorkers)
+	}
+	if name != kDefaultPool {
+		if size == 0 {
+			o.moveQueued(p, o.pool(kDefaultPool), "")
+		} else if p.size == 0 {
+			// Take over requests of our type queued in the default pool.
+			o.moveQueued(o.pool(kDefaultPool), p, name)
+		}
+	}
+	p.size = size
+	for len(p.workers) < size {
+		w := &Worker{
+			ID:       o.nextWorkerID,
+			Pool:     name,
+			Work:     make(chan *WorkRequest, 1),
+			QuitChan: make(chan bool, 1),
+			finished: o.finished,
+		}
+		o.nextWorkerID++
+		p.workers = append(p.workers, w)
+		p.idle = append(p.idle, w)
+		w.Start()
+	}
+	for len(p.workers) > size && len(p.idle) > 0 {
+		o.retire(p, p.idle[len(p.idle)-1])
+	}
+	o.poke()
+	return nil
+}
+
+// retire stops an idle worker. Called with the mutex held.
+func (o *Overlord) retire(p *workerPool, w *Worker) {
+	for i, idle := range p.idle {
+		if idle == w {
+			p.idle = append(p.idle[:i], p.idle[i+1:]...)
+			break
+		}
+	}
+	for i, worker := range p.workers {
+		if worker == w {
+			p.workers = append(p.workers[:i], p.workers[i+1:]...)
+			break
+		}
+	}
+	w.QuitChan <- true
+}
+
+// workerDone makes a worker that finished a job available again, unless its
+// pool shrank in the meantime. Called with the mutex held.
+func (o *Overlord) workerDone(w *Worker) {
+	p := o.pools[w.Pool]
+	p.idle = append(p.idle, w)
+	if len(p.workers) > p.size {
+		o.retire(p, w)
+	}
+}
+
+// dispatch hands runnable requests to idle workers. Called with the mutex
+// held.
+func (o *Overlord) dispatch() {
+	for _, p := range o.pools {
+		for len(p.idle) > 0 {
+			r := o.next(p)
+			if r == nil {
+				break
+			}
+			w := p.idle[len(p.idle)-1]
+			p.idle = p.idle[:len(p.idle)-1]
+			w.Work <- r
+		}
+	}
+}
+
+func (o *Overlord) GetPools() []PoolStatus {
+	o.mutex.RLock()
+	defer o.mutex.RUnlock()
+	pools := []PoolStatus{}
+	for _, p := range o.pools {
+		pools = append(pools, PoolStatus{
+			Name:    p.name,
+			Size:    p.size,
+			Workers: len(p.workers),
+			Busy:    len(p.workers) - len(p.idle),
+			Queued:  p.ready.Len(),
+		})
+	}
+	sort.Slice(pools, func(i, j int) bool {
+		return pools[i].Name < pools[j].Name
+	})
+	return pools
+}
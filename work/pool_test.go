@@ -0,0 +1,57 @@
+package work
+
+import "testing"
+
+func TestResizeDefaultPoolToZero(t *testing.T) {
+	o, _, _ := newTestOverlord(t, 1)
+	if err := o.Resize(kDefaultPool, 0); err == nil {
+		t.Fatal("Default pool emptied.")
+	}
+}
+
+func TestEmptyPoolHandsBackToDefault(t *testing.T) {
+	o := NewOverlord()
+	ok := &fakeHandler{name: "ok"}
+	o.RegisterHandler(ok)
+	if err := o.Resize("ok", 1); err != nil {
+		t.Fatal(err)
+	}
+	// Queued in the ok pool until it is emptied, as nothing dispatches yet.
+	queued := newTestRequest(o, "ok", "queued")
+	if err := o.Submit(queued); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Resize("ok", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Resize(kDefaultPool, 1); err != nil {
+		t.Fatal(err)
+	}
+	o.StartDispatching()
+	later := newTestRequest(o, "ok", "later")
+	if err := o.Submit(later); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range []*WorkRequest{queued, later} {
+		if ev := wait(t, o, r); !ev.Success {
+			t.Fatalf("Work %s failed: %+v", r.Params["name"], ev)
+		}
+	}
+
+	// Growing the pool again takes the type back.
+	if err := o.Resize("ok", 1); err != nil {
+		t.Fatal(err)
+	}
+	again := newTestRequest(o, "ok", "again")
+	if err := o.Submit(again); err != nil {
+		t.Fatal(err)
+	}
+	if ev := wait(t, o, again); !ev.Success {
+		t.Fatalf("Work again failed: %+v", ev)
+	}
+	for _, p := range o.GetPools() {
+		if p.Name == "ok" && p.Workers != 1 {
+			t.Fatalf("Pool not grown again: %+v", p)
+		}
+	}
+}
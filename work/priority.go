@@ -0,0 +1,103 @@
+package work
+
+import (
+	"container/heap"
+	"fmt"
+)
+
+// Priority of a request. Free workers always get the runnable request of the
+// highest priority.
+type Priority int
+
+const (
+	PRIORITY_BACKGROUND  Priority = iota
+	PRIORITY_NORMAL      Priority = iota
+	PRIORITY_INTERACTIVE Priority = iota
+)
+
+var priorityNames = map[Priority]string{
+	PRIORITY_BACKGROUND:  "background",
+	PRIORITY_NORMAL:      "normal",
+	PRIORITY_INTERACTIVE: "interactive",
+}
+
+func (p Priority) String() string {
+	if name, ok := priorityNames[p]; ok {
+		return name
+	}
+	return fmt.Sprintf("priority(%d)", int(p))
+}
+
+func ParsePriority(s string) (Priority, error) {
+	for p, name := range priorityNames {
+		if name == s {
+			return p, nil
+		}
+	}
+	return PRIORITY_NORMAL, fmt.Errorf("Unknown priority %q.", s)
+}
+
+// readyQueue is a heap of runnable requests, by priority and then in order of
+// becoming runnable.
+type readyQueue []*WorkRequest
+
+func (q readyQueue) Len() int {
+	return len(q)
+}
+
+func (q readyQueue) Less(i, j int) bool {
+	if q[i].Priority != q[j].Priority {
+		return q[i].Priority > q[j].Priority
+	}
+	return q[i].readySeq < q[j].readySeq
+}
+
+func (q readyQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].readyIndex = i
+	q[j].readyIndex = j
+}
+
+func (q *readyQueue) Push(x interface{}) {
+	r := x.(*WorkRequest)
+	r.readyIndex = len(*q)
+	*q = append(*q, r)
+}
+
+func (q *readyQueue) Pop() interface{} {
+	old := *q
+	r := old[len(old)-1]
+	old[len(old)-1] = nil
+	r.readyIndex = -1
+	*q = old[:len(old)-1]
+	return r
+}
+
+// raisePriority raises the priority of a request and of everything it waits
+// for, so that an interactive request is never stuck behind a background one
+// it depends on. Called with the mutex held.
+func (o *Overlord) raisePriority(r *WorkRequest, p Priority) {
+	if r.Done || r.Priority >= p {
+		return
+	}
+	r.Priority = p
+	if r.readyIndex >= 0 {
+		heap.Fix(&r.pool.ready, r.readyIndex)
+	}
+	o.journal(r)
+	for _, d := range r.Depends {
+		o.raisePriority(d, p)
+	}
+}
+
+// RaisePriority raises the priority of unfinished requests, and of everything
+// they wait for.
+func (o *Overlord) RaisePriority(uids []int64, p Priority) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	for _, uid := range uids {
+		if r := o.workDirectory[uid]; r != nil {
+			o.raisePriority(r, p)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package work
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// See ffprobe(1) -print_format json.
+type ffprobeOutput struct {
+	Streams []struct {
+		CodecType   string `json:"codec_type"`
+		Disposition struct {
+			AttachedPic int `json:"attached_pic"`
+		} `json:"disposition"`
+	} `json:"streams"`
+	Format struct {
+		Duration string `json:"duration"`
+	} `json:"format"`
+}
+
+type probeResult struct {
+	HasVideo bool
+	HasAudio bool
+	// Zero if unknown.
+	Duration time.Duration
+}
+
+// probe inspects a media file with ffprobe. Cover art attached to audio files
+// does not count as video.
+func probe(ctx context.Context, path string) (*probeResult, error) {
+	cmd := command(ctx, "ffprobe",
+		"-v", "error",
+		"-print_format", "json",
+		"-show_streams",
+		"-show_format",
+		path,
+	)
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	exited, err := startCommand(ctx, cmd)
+	if err != nil {
+		return nil, err
+	}
+	err = cmd.Wait()
+	exited()
+	if err != nil {
+		appendOutput(ctx, "$ ffprobe %s\n%s", path, stderr.Bytes())
+		lines := strings.Split(strings.TrimSpace(stderr.String()), "\n")
+		return nil, commandError("ffprobe", err, lines[len(lines)-1])
+	}
+	out := stdout.Bytes()
+	p := ffprobeOutput{}
+	if err := json.Unmarshal(out, &p); err != nil {
+		return nil, err
+	}
+	res := &probeResult{}
+	if seconds, err := strconv.ParseFloat(p.Format.Duration, 64); err == nil {
+		res.Duration = time.Duration(seconds * float64(time.Second))
+	}
+	for _, s := range p.Streams {
+		switch s.CodecType {
+		case "video":
+			if s.Disposition.AttachedPic == 0 {
+				res.HasVideo = true
+			}
+		case "audio":
+			res.HasAudio = true
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,184 @@
+package work
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Profile every video is converted with, unless configured otherwise.
+	DefaultProfile = "default"
+	// Frame rate of generated video, like visualizations and images, when the
+	// profile does not say.
+	kDefaultFPS = 30
+)
+
+// Profile describes how videos are converted for a kind of display.
+type Profile struct {
+	Width  int `json:"width"`
+	Height int `json:"height"`
+	// How to deal with sources of another aspect ratio: "crop" to fill the
+	// display, "fit" to keep everything at a smaller size, or "letterbox" to
+	// fit and pad with black.
+	Mode         string `json:"mode"`
+	VideoCodec   string `json:"video_codec"`
+	VideoBitrate string `json:"video_bitrate"`
+	// Zero keeps the frame rate of the source.
+	FPS        int    `json:"fps"`
+	Audio      bool   `json:"audio"`
+	AudioCodec string `json:"audio_codec"`
+}
+
+// defaultProfile is what webled converted everything to before profiles.
+var defaultProfile = Profile{
+	Width:        128,
+	Height:       128,
+	Mode:         "crop",
+	VideoCodec:   "libvpx",
+	VideoBitrate: "1M",
+	Audio:        true,
+	AudioCodec:   "libvorbis",
+}
+
+// DefaultProfiles returns the profiles used when none are configured.
+func DefaultProfiles() map[string]Profile {
+	return map[string]Profile{DefaultProfile: defaultProfile}
+}
+
+// LoadProfiles reads profiles by name from a JSON file. Settings missing from
+// a profile are taken from the default one, which is always present.
+func LoadProfiles(path string) (map[string]Profile, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	raw := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	profiles := DefaultProfiles()
+	for name, r := range raw {
+		p := defaultProfile
+		if err := json.Unmarshal(r, &p); err != nil {
+			return nil, fmt.Errorf("Invalid profile %s: %v", name, err)
+		}
+		if err := p.validate(); err != nil {
+			return nil, fmt.Errorf("Invalid profile %s: %v", name, err)
+		}
+		profiles[name] = p
+	}
+	return profiles, nil
+}
+
+func (p Profile) validate() error {
+	if p.Width <= 0 || p.Height <= 0 || p.Width%2 != 0 || p.Height%2 != 0 {
+		return fmt.Errorf("Resolution must be positive and even, got %dx%d.", p.Width, p.Height)
+	}
+	switch p.Mode {
+	case "crop", "fit", "letterbox":
+	default:
+		return fmt.Errorf("Unknown mode %q.", p.Mode)
+	}
+	if p.FPS < 0 {
+		return fmt.Errorf("Invalid frame rate %d.", p.FPS)
+	}
+	return nil
+}
+
+// params adds the profile to the parameters of a job.
+func (p Profile) params(params Params) Params {
+	params["width"] = strconv.Itoa(p.Width)
+	params["height"] = strconv.Itoa(p.Height)
+	params["mode"] = p.Mode
+	params["video_codec"] = p.VideoCodec
+	params["video_bitrate"] = p.VideoBitrate
+	params["fps"] = strconv.Itoa(p.FPS)
+	params["audio"] = strconv.FormatBool(p.Audio)
+	params["audio_codec"] = p.AudioCodec
+	return params
+}
+
+// profileFromParams reads back what params wrote. Jobs journaled before
+// profiles existed get the default profile.
+func profileFromParams(params Params) (Profile, error) {
+	p := defaultProfile
+	if params["width"] == "" {
+		return p, nil
+	}
+	var err error
+	if p.Width, err = strconv.Atoi(params["width"]); err != nil {
+		return p, err
+	}
+	if p.Height, err = strconv.Atoi(params["height"]); err != nil {
+		return p, err
+	}
+	if p.FPS, err = strconv.Atoi(params["fps"]); err != nil {
+		return p, err
+	}
+	if p.Audio, err = strconv.ParseBool(params["audio"]); err != nil {
+		return p, err
+	}
+	p.Mode = params["mode"]
+	p.VideoCodec = params["video_codec"]
+	p.VideoBitrate = params["video_bitrate"]
+	p.AudioCodec = params["audio_codec"]
+	return p, p.validate()
+}
+
+// scaleFilter returns the ffmpeg filters bringing video to the profile's
+// resolution.
+func (p Profile) scaleFilter() string {
+	w, h := p.Width, p.Height
+	switch p.Mode {
+	case "fit":
+		// Keep both sides even, as required by yuv420p.
+		return fmt.Sprintf("scale=%d:%d:force_original_aspect_ratio=decrease,scale=trunc(iw/2)*2:trunc(ih/2)*2", w, h)
+	case "letterbox":
+		return fmt.Sprintf("scale=%d:%d:force_original_aspect_ratio=decrease,pad=%d:%d:(ow-iw)/2:(oh-ih)/2", w, h, w, h)
+	}
+	return fmt.Sprintf("scale=%d:%d:force_original_aspect_ratio=increase,crop=%d:%d", w, h, w, h)
+}
+
+// fps returns the frame rate of generated video.
+func (p Profile) fps() int {
+	if p.FPS == 0 {
+		return kDefaultFPS
+	}
+	return p.FPS
+}
+
+// Rendition is a conversion of a video with some profile.
+type Rendition struct {
+	Profile    string
+	TargetPath string
+}
+
+// RenditionFile returns where the rendition of file with a profile is kept:
+// file itself for the default profile, and next to it otherwise, eg.
+// foo.small.webm for foo.webm.
+func RenditionFile(file, profile string) string {
+	if profile == DefaultProfile {
+		return file
+	}
+	ext := filepath.Ext(file)
+	return fmt.Sprintf("%s.%s%s", strings.TrimSuffix(file, ext), profile, ext)
+}
+
+// Renditions returns a rendition of file for every profile, sorted by name.
+func (o *Overlord) Renditions(file string) []Rendition {
+	names := []string{}
+	for name := range o.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	renditions := []Rendition{}
+	for _, name := range names {
+		renditions = append(renditions, Rendition{Profile: name, TargetPath: RenditionFile(file, name)})
+	}
+	return renditions
+}
@@ -0,0 +1,31 @@
+package work
+
+import (
+	"os"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/trace"
+)
+
+// removeFileHandler removes params["path"], if it exists.
+type removeFileHandler struct{}
+
+func init() {
+	registerBuiltin(removeFileHandler{})
+}
+
+func (removeFileHandler) Name() string {
+	return "remove_file"
+}
+
+func (removeFileHandler) Run(ctx context.Context, params Params) error {
+	if tr, ok := trace.FromContext(ctx); ok {
+		tr.LazyPrintf("Removing file %s...", params["path"])
+	}
+	os.Remove(params["path"])
+	return nil
+}
+
+func (removeFileHandler) Describe(params Params) string {
+	return "Removing file " + params["path"]
+}
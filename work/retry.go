@@ -0,0 +1,40 @@
+package work
+
+import (
+	"time"
+
+	"github.com/jpillora/backoff"
+)
+
+// RetryPolicy says how often a failed job is attempted again, and how long to
+// wait in between.
+type RetryPolicy struct {
+	// Total number of attempts, including the first one.
+	MaxAttempts int
+	Backoff     backoff.Backoff
+}
+
+// Retrier is implemented by JobHandlers whose jobs are worth retrying when
+// they fail, eg. because of network trouble. Other jobs are only attempted
+// once.
+type Retrier interface {
+	RetryPolicy() RetryPolicy
+}
+
+// networkRetryPolicy is for jobs fetching things from the internet.
+var networkRetryPolicy = RetryPolicy{
+	MaxAttempts: 4,
+	Backoff: backoff.Backoff{
+		Min:    5 * time.Second,
+		Max:    2 * time.Minute,
+		Factor: 3,
+		Jitter: true,
+	},
+}
+
+func retryPolicy(h JobHandler) RetryPolicy {
+	if r, ok := h.(Retrier); ok {
+		return r.RetryPolicy()
+	}
+	return RetryPolicy{MaxAttempts: 1}
+}
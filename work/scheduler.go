@@ -0,0 +1,234 @@
+package work
+
+import (
+	"container/heap"
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/trace"
+)
+
+// workResult is sent by workers to the dispatcher when they finish a
+// request.
+type workResult struct {
+	request *WorkRequest
+	worker  *Worker
+	err     error
+}
+
+// Submit schedules requests to be run once all their dependencies are done.
+// Requests can only depend on requests submitted earlier or in the same
+// call, and must not form a cycle.
+func (o *Overlord) Submit(reqs ...*WorkRequest) error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	batch := make(map[*WorkRequest]bool)
+	for _, r := range reqs {
+		batch[r] = true
+	}
+	for _, r := range reqs {
+		if r.handler == nil {
+			return fmt.Errorf("Unknown job type %q.", r.Type)
+		}
+		for _, d := range r.Depends {
+			if !batch[d] && o.workDirectory[d.UID] != d {
+				return fmt.Errorf("Work %d depends on unknown work %d.", r.UID, d.UID)
+			}
+		}
+	}
+	if err := checkCycles(reqs); err != nil {
+		return err
+	}
+
+	for _, r := range reqs {
+		o.workDirectory[r.UID] = r
+		o.journal(r)
+		r.waiting = 0
+		r.readyIndex = -1
+		for _, d := range r.Depends {
+			if d.Done {
+				continue
+			}
+			r.waiting++
+			d.dependents = append(d.dependents, r)
+			o.raisePriority(d, r.Priority)
+		}
+	}
+	for _, r := range reqs {
+		if r.waiting == 0 {
+			o.runnable(r)
+		}
+	}
+	o.poke()
+	return nil
+}
+
+// poke makes the dispatcher look at the ready queue again.
+func (o *Overlord) poke() {
+	select {
+	case o.wake <- true:
+	default:
+	}
+}
+
+// checkCycles makes sure that no request depends on itself, directly or
+// through other requests.
+func checkCycles(reqs []*WorkRequest) error {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[*WorkRequest]int)
+	var visit func(r *WorkRequest) error
+	visit = func(r *WorkRequest) error {
+		switch state[r] {
+		case visiting:
+			return fmt.Errorf("Dependency cycle through work %d.", r.UID)
+		case visited:
+			return nil
+		}
+		state[r] = visiting
+		for _, d := range r.Depends {
+			if err := visit(d); err != nil {
+				return err
+			}
+		}
+		state[r] = visited
+		return nil
+	}
+	for _, r := range reqs {
+		if err := visit(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runnable is called with the mutex held once all dependencies of a request
+// are done. It either queues the request or finishes it right away if it
+// should not run anymore.
+func (o *Overlord) runnable(r *WorkRequest) {
+	if r.Cancelled {
+		if tr, ok := trace.FromContext(r.context); ok {
+			tr.LazyPrintf("Cancelled, skipping.")
+		}
+		o.finish(r, false)
+		return
+	}
+	if !r.AlwaysRun {
+		for _, d := range r.Depends {
+			if !d.Success {
+				if tr, ok := trace.FromContext(r.context); ok {
+					tr.LazyPrintf("Parent work %d failed, skipping.", d.UID)
+				}
+				o.finish(r, false)
+				return
+			}
+		}
+	}
+	if tr, ok := trace.FromContext(r.context); ok {
+		tr.LazyPrintf("Runnable at %s priority.", r.Priority)
+	}
+	r.readySeq = o.readySeq
+	o.readySeq++
+	r.pool = o.poolFor(r.Type)
+	heap.Push(&r.pool.ready, r)
+}
+
+// finish is called with the mutex held to mark a request as done and unblock
+// its dependents.
+func (o *Overlord) finish(r *WorkRequest, success bool) {
+	r.Done = true
+	r.Success = success
+	r.Finished = time.Now()
+	r.cancel()
+	if tr, ok := trace.FromContext(r.context); ok {
+		if !success {
+			tr.SetError()
+		}
+		tr.Finish()
+	}
+	o.journal(r)
+	o.saveOutput(r)
+	r.publishDone()
+	for _, d := range r.dependents {
+		d.waiting--
+		if d.waiting == 0 {
+			o.runnable(d)
+		}
+	}
+	o.prune(r.Finished)
+}
+
+// result handles a request coming back from a worker, retrying it later if
+// it failed and its handler's RetryPolicy allows. Called with the mutex held.
+func (o *Overlord) result(res workResult) {
+	r := res.request
+	if res.err == nil {
+		o.finish(r, true)
+		return
+	}
+	r.LastError = jobError(res.err)
+	policy := retryPolicy(r.handler)
+	if r.Cancelled || r.Attempts >= policy.MaxAttempts {
+		o.finish(r, false)
+		return
+	}
+	delay := policy.Backoff.ForAttempt(float64(r.Attempts - 1))
+	glog.Warningf("Work %d failed (attempt %d of %d), retrying in %v.", r.UID, r.Attempts, policy.MaxAttempts, delay)
+	if tr, ok := trace.FromContext(r.context); ok {
+		tr.LazyPrintf("Attempt %d of %d failed, retrying in %v.", r.Attempts, policy.MaxAttempts, delay)
+	}
+	o.journal(r)
+	time.AfterFunc(delay, func() {
+		o.mutex.Lock()
+		o.runnable(r)
+		o.mutex.Unlock()
+		o.poke()
+	})
+}
+
+// next pops the next request for a pool to run, or returns nil if there is
+// none.
+func (o *Overlord) next(p *workerPool) *WorkRequest {
+	for p.ready.Len() > 0 {
+		r := heap.Pop(&p.ready).(*WorkRequest)
+		if r.Cancelled {
+			if tr, ok := trace.FromContext(r.context); ok {
+				tr.LazyPrintf("Cancelled, skipping.")
+			}
+			o.finish(r, false)
+			continue
+		}
+		r.Attempts++
+		r.timeout = o.jobTimeout(r)
+		o.journal(r)
+		if tr, ok := trace.FromContext(r.context); ok {
+			tr.LazyPrintf("Dispatching to %s pool...", p.name)
+		}
+		return r
+	}
+	return nil
+}
+
+func (o *Overlord) StartDispatching() {
+	go func() {
+		for {
+			o.mutex.Lock()
+			o.dispatch()
+			o.mutex.Unlock()
+
+			select {
+			case <-o.wake:
+			case res := <-o.finished:
+				o.mutex.Lock()
+				o.result(res)
+				o.workerDone(res.worker)
+				o.mutex.Unlock()
+			}
+		}
+	}()
+}
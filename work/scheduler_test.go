@@ -0,0 +1,196 @@
+package work
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// fakeHandler runs jobs by calling run, recording the order in which they
+// start under params["name"].
+type fakeHandler struct {
+	name string
+	run  func(params Params) error
+
+	mutex   sync.Mutex
+	started []string
+}
+
+func (h *fakeHandler) Name() string {
+	return h.name
+}
+
+func (h *fakeHandler) Run(ctx context.Context, params Params) error {
+	h.mutex.Lock()
+	h.started = append(h.started, params["name"])
+	h.mutex.Unlock()
+	if h.run == nil {
+		return nil
+	}
+	return h.run(params)
+}
+
+func (h *fakeHandler) Describe(params Params) string {
+	return "Fake " + params["name"]
+}
+
+func (h *fakeHandler) Started() []string {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return append([]string{}, h.started...)
+}
+
+// newTestOverlord returns a dispatching Overlord with fake handlers "ok" and
+// "fail", the latter failing every job.
+func newTestOverlord(t *testing.T, workers int) (*Overlord, *fakeHandler, *fakeHandler) {
+	o := NewOverlord()
+	ok := &fakeHandler{name: "ok"}
+	fail := &fakeHandler{name: "fail", run: func(Params) error {
+		return errors.New("Failed on purpose.")
+	}}
+	o.RegisterHandler(ok)
+	o.RegisterHandler(fail)
+	if err := o.Resize(kDefaultPool, workers); err != nil {
+		t.Fatal(err)
+	}
+	o.StartDispatching()
+	return o, ok, fail
+}
+
+func newTestRequest(o *Overlord, t, name string, depends ...*WorkRequest) *WorkRequest {
+	r := o.NewRequest(context.Background(), t, Params{"name": name})
+	r.Depends = depends
+	return r
+}
+
+// wait returns the last event of a request.
+func wait(t *testing.T, o *Overlord, r *WorkRequest) Event {
+	events, _, err := o.Subscribe(r.UID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case ev := <-events:
+			if ev.Done {
+				return ev
+			}
+		case <-timeout:
+			t.Fatalf("Work %s not done in time.", r.Params["name"])
+		}
+	}
+}
+
+func TestDispatchAfterParent(t *testing.T) {
+	o, ok, _ := newTestOverlord(t, 2)
+	release := make(chan bool)
+	parentHandler := &fakeHandler{name: "parent", run: func(Params) error {
+		<-release
+		return nil
+	}}
+	o.RegisterHandler(parentHandler)
+
+	parent := newTestRequest(o, "parent", "parent")
+	child := newTestRequest(o, "ok", "child", parent)
+	if err := o.Submit(parent, child); err != nil {
+		t.Fatal(err)
+	}
+	// Give an idle worker the chance to wrongly pick up the child.
+	time.Sleep(50 * time.Millisecond)
+	if started := ok.Started(); len(started) != 0 {
+		t.Fatalf("Child started before its parent finished: %v", started)
+	}
+	close(release)
+	if ev := wait(t, o, child); !ev.Success {
+		t.Fatalf("Child failed: %+v", ev)
+	}
+}
+
+func TestMultipleParents(t *testing.T) {
+	o, ok, _ := newTestOverlord(t, 1)
+	a := newTestRequest(o, "ok", "a")
+	b := newTestRequest(o, "ok", "b")
+	child := newTestRequest(o, "ok", "child", a, b)
+	// Submitted first, so that it would run first if it did not wait.
+	if err := o.Submit(child, a, b); err != nil {
+		t.Fatal(err)
+	}
+	if ev := wait(t, o, child); !ev.Success {
+		t.Fatalf("Child failed: %+v", ev)
+	}
+	started := ok.Started()
+	if len(started) != 3 || started[2] != "child" {
+		t.Fatalf("Child did not run after both parents: %v", started)
+	}
+}
+
+func TestSubmitRejectsCycles(t *testing.T) {
+	o, ok, _ := newTestOverlord(t, 1)
+	a := newTestRequest(o, "ok", "a")
+	b := newTestRequest(o, "ok", "b", a)
+	c := newTestRequest(o, "ok", "c", b)
+	a.Depends = []*WorkRequest{c}
+	if err := o.Submit(a, b, c); err == nil {
+		t.Fatal("Cycle accepted.")
+	}
+
+	self := newTestRequest(o, "ok", "self")
+	self.Depends = []*WorkRequest{self}
+	if err := o.Submit(self); err == nil {
+		t.Fatal("Self dependency accepted.")
+	}
+
+	if ws := o.GetAllWorkStatus(); len(ws) != 0 {
+		t.Fatalf("Rejected work tracked: %+v", ws)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if started := ok.Started(); len(started) != 0 {
+		t.Fatalf("Rejected work started: %v", started)
+	}
+}
+
+func TestFailedParentSkipsDependents(t *testing.T) {
+	o, ok, _ := newTestOverlord(t, 2)
+	parent := newTestRequest(o, "fail", "parent")
+	child := newTestRequest(o, "ok", "child", parent)
+	grandchild := newTestRequest(o, "ok", "grandchild", child)
+	if err := o.Submit(parent, child, grandchild); err != nil {
+		t.Fatal(err)
+	}
+	if ev := wait(t, o, parent); ev.Success || ev.Error == nil {
+		t.Fatalf("Parent did not fail: %+v", ev)
+	}
+	for _, r := range []*WorkRequest{child, grandchild} {
+		if ev := wait(t, o, r); ev.Success {
+			t.Fatalf("Dependent %s of failed parent succeeded.", r.Params["name"])
+		}
+	}
+	if started := ok.Started(); len(started) != 0 {
+		t.Fatalf("Dependents of failed parent ran: %v", started)
+	}
+}
+
+func TestAlwaysRunAfterFailure(t *testing.T) {
+	o, ok, _ := newTestOverlord(t, 2)
+	parent := newTestRequest(o, "fail", "parent")
+	child := newTestRequest(o, "ok", "child", parent)
+	cleanup := newTestRequest(o, "ok", "cleanup", parent, child)
+	cleanup.AlwaysRun = true
+	if err := o.Submit(parent, child, cleanup); err != nil {
+		t.Fatal(err)
+	}
+	if ev := wait(t, o, cleanup); !ev.Success {
+		t.Fatalf("Cleanup failed: %+v", ev)
+	}
+	if ev := wait(t, o, child); ev.Success {
+		t.Fatal("Child of failed parent succeeded.")
+	}
+	started := ok.Started()
+	if len(started) != 1 || started[0] != "cleanup" {
+		t.Fatalf("Expected only cleanup to run, got %v", started)
+	}
+}
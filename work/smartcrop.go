@@ -0,0 +1,329 @@
+package work
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	"golang.org/x/net/trace"
+)
+
+const (
+	// Width of the frames looked at to find the action.
+	kAnalysisWidth = 64
+	// Frames looked at per second of video.
+	kAnalysisFPS = 2
+	// How much motion counts for compared to detail when finding the
+	// action.
+	kMotionWeight = 4
+	// Window over which the center of the action is averaged, so that the
+	// crop pans smoothly instead of jumping around.
+	kPanSmoothing = 4 * time.Second
+	// Time between points of the pan path, and how many there may be at
+	// most, as they all end up in a single ffmpeg expression.
+	kPanInterval  = 2 * time.Second
+	kMaxPanPoints = 150
+)
+
+// cropAnalysis is what analyzeCropHandler finds out about a video.
+type cropAnalysis struct {
+	// Black bars to remove, as a crop in pixels of the source. Zero if
+	// unknown.
+	Bars struct {
+		W int `json:"w"`
+		H int `json:"h"`
+		X int `json:"x"`
+		Y int `json:"y"`
+	} `json:"bars"`
+	// Center of the action over time, sorted by time.
+	Path []panPoint `json:"path"`
+}
+
+// panPoint is the center of the action at some time, as a fraction of the
+// size of the video without its bars.
+type panPoint struct {
+	Time float64 `json:"t"`
+	X    float64 `json:"x"`
+	Y    float64 `json:"y"`
+}
+
+func loadCropAnalysis(path string) (*cropAnalysis, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	a := &cropAnalysis{}
+	if err := json.Unmarshal(data, a); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// analyzeCropHandler finds the black bars and where the action is in the
+// video at params["source"], writing a cropAnalysis as JSON to
+// params["target"] for convertHandler to follow. Analysis is best effort: if
+// it fails, nothing is written and videos are cropped at their center.
+type analyzeCropHandler struct{}
+
+func init() {
+	registerBuiltin(analyzeCropHandler{})
+}
+
+func (analyzeCropHandler) Name() string {
+	return "analyze_crop"
+}
+
+func (analyzeCropHandler) Run(ctx context.Context, params Params) error {
+	a, err := analyzeCrop(ctx, params["source"])
+	if err == nil {
+		var data []byte
+		if data, err = json.Marshal(a); err == nil {
+			err = ioutil.WriteFile(params["target"], data, 0644)
+		}
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return err
+		}
+		glog.Warningf("Could not analyze %s, cropping at the center: %v", params["source"], err)
+		appendOutput(ctx, "Analysis failed, cropping at the center: %v\n", err)
+		return nil
+	}
+	if tr, ok := trace.FromContext(ctx); ok {
+		tr.LazyPrintf("Bars %+v, %d pan points.", a.Bars, len(a.Path))
+	}
+	return nil
+}
+
+func (analyzeCropHandler) Timeout() time.Duration {
+	return time.Hour
+}
+
+func (analyzeCropHandler) Describe(params Params) string {
+	return "Analyzing crop of " + params["source"]
+}
+
+func analyzeCrop(ctx context.Context, source string) (*cropAnalysis, error) {
+	p, err := probe(ctx, source)
+	if err != nil {
+		return nil, err
+	}
+	a := &cropAnalysis{Path: []panPoint{}}
+	if !p.HasVideo {
+		return a, nil
+	}
+	if err := detectBars(ctx, source, a); err != nil {
+		return nil, err
+	}
+	if err := trackAction(ctx, source, a); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// detectBars runs ffmpeg's cropdetect over the whole video, keeping the
+// largest crop it comes up with. Its per frame metadata is not kept as output.
+func detectBars(ctx context.Context, source string, a *cropAnalysis) error {
+	onLine := func(line string) bool {
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return true
+		}
+		v, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return true
+		}
+		switch parts[0] {
+		case "lavfi.cropdetect.w":
+			a.Bars.W = v
+		case "lavfi.cropdetect.h":
+			a.Bars.H = v
+		case "lavfi.cropdetect.x":
+			a.Bars.X = v
+		case "lavfi.cropdetect.y":
+			a.Bars.Y = v
+		}
+		return true
+	}
+	return runCommand(ctx, onLine, "ffmpeg", "-v", "error", "-nostats",
+		"-i", source,
+		"-an",
+		"-vf", "fps=1,cropdetect=24:2:0,metadata=mode=print:file=-",
+		"-f", "null", "-",
+	)
+}
+
+// trackAction samples small grayscale frames of the video, without its bars,
+// and follows the center of motion and detail in them.
+func trackAction(ctx context.Context, source string, a *cropAnalysis) error {
+	w, h := kAnalysisWidth, kAnalysisWidth*9/16
+	filter := ""
+	if a.Bars.W > 0 && a.Bars.H > 0 {
+		filter = fmt.Sprintf("crop=%d:%d:%d:%d,", a.Bars.W, a.Bars.H, a.Bars.X, a.Bars.Y)
+		h = kAnalysisWidth * a.Bars.H / a.Bars.W
+	}
+	if h < 2 {
+		h = 2
+	}
+	filter += fmt.Sprintf("fps=%d,scale=%d:%d,format=gray", kAnalysisFPS, w, h)
+
+	cmd := command(ctx, "ffmpeg", "-v", "error", "-nostats",
+		"-i", source,
+		"-an",
+		"-vf", filter,
+		"-f", "rawvideo", "-",
+	)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	exited, err := startCommand(ctx, cmd)
+	if err != nil {
+		return err
+	}
+	centers := []panPoint{}
+	prev := []byte(nil)
+	frame := make([]byte, w*h)
+	for i := 0; ; i++ {
+		if _, err = io.ReadFull(stdout, frame); err != nil {
+			break
+		}
+		c, ok := actionCenter(frame, prev, w, h)
+		if !ok {
+			c = panPoint{X: 0.5, Y: 0.5}
+			if len(centers) > 0 {
+				c = centers[len(centers)-1]
+			}
+		}
+		c.Time = float64(i) / kAnalysisFPS
+		centers = append(centers, c)
+		prev = append(prev[:0], frame...)
+	}
+	// Drain whatever is left so that ffmpeg is not stuck writing.
+	io.Copy(ioutil.Discard, stdout)
+	err = cmd.Wait()
+	exited()
+	if err != nil {
+		appendOutput(ctx, "$ ffmpeg %s\n%s", filter, stderr.Bytes())
+		lines := strings.Split(strings.TrimSpace(stderr.String()), "\n")
+		return commandError("ffmpeg", err, lines[len(lines)-1])
+	}
+	a.Path = panPath(centers)
+	return nil
+}
+
+// actionCenter returns the center of a grayscale frame weighted by motion
+// since the previous frame, if any, and detail. Only pixels standing out
+// from the rest count. It returns false if nothing stands out.
+func actionCenter(frame, prev []byte, w, h int) (panPoint, bool) {
+	weights := make([]float64, w*h)
+	total := 0.0
+	for y := 0; y < h-1; y++ {
+		for x := 0; x < w-1; x++ {
+			i := y*w + x
+			v := int(frame[i])
+			detail := abs(v-int(frame[i+1])) + abs(v-int(frame[i+w]))
+			weight := float64(detail)
+			if prev != nil {
+				weight += kMotionWeight * float64(abs(v-int(prev[i])))
+			}
+			weights[i] = weight
+			total += weight
+		}
+	}
+	mean := total / float64(len(weights))
+	sum, sx, sy := 0.0, 0.0, 0.0
+	for i, weight := range weights {
+		weight -= mean
+		if weight <= 0 {
+			continue
+		}
+		sum += weight
+		sx += weight * (float64(i%w) + 0.5)
+		sy += weight * (float64(i/w) + 0.5)
+	}
+	if sum == 0 {
+		return panPoint{}, false
+	}
+	return panPoint{X: sx / sum / float64(w), Y: sy / sum / float64(h)}, true
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// panPath smooths centers sampled at kAnalysisFPS with a moving average, and
+// thins them out to one every kPanInterval, or less if there would be more
+// than kMaxPanPoints.
+func panPath(centers []panPoint) []panPoint {
+	path := []panPoint{}
+	if len(centers) == 0 {
+		return path
+	}
+	half := int(kPanSmoothing.Seconds() * kAnalysisFPS / 2)
+	step := int(kPanInterval.Seconds() * kAnalysisFPS)
+	if n := len(centers) / step; n > kMaxPanPoints {
+		step = int(math.Ceil(float64(len(centers)) / kMaxPanPoints))
+	}
+	for i := 0; i < len(centers); i += step {
+		p := panPoint{Time: centers[i].Time}
+		n := 0
+		for j := i - half; j <= i+half; j++ {
+			if j < 0 || j >= len(centers) {
+				continue
+			}
+			p.X += centers[j].X
+			p.Y += centers[j].Y
+			n++
+		}
+		p.X /= float64(n)
+		p.Y /= float64(n)
+		path = append(path, p)
+	}
+	return path
+}
+
+// panFilter returns the ffmpeg filters bringing video to the profile's
+// resolution by cropping off the bars and following the action along the
+// path, instead of cropping at the center.
+func (p Profile) panFilter(a *cropAnalysis) string {
+	filter := ""
+	if a.Bars.W > 0 && a.Bars.H > 0 {
+		filter = fmt.Sprintf("crop=%d:%d:%d:%d,", a.Bars.W, a.Bars.H, a.Bars.X, a.Bars.Y)
+	}
+	x := panExpression(a.Path, func(p panPoint) float64 { return p.X })
+	y := panExpression(a.Path, func(p panPoint) float64 { return p.Y })
+	return filter + fmt.Sprintf("scale=%d:%d:force_original_aspect_ratio=increase,crop=%d:%d:'clip(iw*(%s)-ow/2,0,iw-ow)':'clip(ih*(%s)-oh/2,0,ih-oh)'",
+		p.Width, p.Height, p.Width, p.Height, x, y)
+}
+
+// panExpression returns an ffmpeg expression of t interpolating linearly
+// between the coordinates of the path.
+func panExpression(path []panPoint, coordinate func(panPoint) float64) string {
+	if len(path) == 0 {
+		return "0.5"
+	}
+	terms := []string{fmt.Sprintf("%.4f", coordinate(path[0]))}
+	for i := 1; i < len(path); i++ {
+		delta := coordinate(path[i]) - coordinate(path[i-1])
+		if math.Abs(delta) < 0.0001 {
+			continue
+		}
+		terms = append(terms, fmt.Sprintf("%.4f*clip((t-%.2f)/%.2f,0,1)",
+			delta, path[i-1].Time, path[i].Time-path[i-1].Time))
+	}
+	return strings.Join(terms, "+")
+}
@@ -0,0 +1,90 @@
+package work
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/trace"
+)
+
+const (
+	// Length and frame rate of animated previews.
+	kPreviewDuration = 3 * time.Second
+	kPreviewFPS      = 10
+)
+
+// thumbnailHandler extracts a representative frame of the video at
+// params["source"] into a PNG at params["target"], and unless
+// params["preview"] is empty, a short animated GIF from around the same spot
+// there. Both keep the resolution of the video.
+type thumbnailHandler struct{}
+
+func init() {
+	registerBuiltin(thumbnailHandler{})
+}
+
+func (thumbnailHandler) Name() string {
+	return "thumbnail"
+}
+
+func (thumbnailHandler) Run(ctx context.Context, params Params) error {
+	p, err := probe(ctx, params["source"])
+	if err != nil {
+		return err
+	}
+	if !p.HasVideo {
+		return errors.New("Source has no video.")
+	}
+	// Skip intros, and let ffmpeg pick the most representative of the
+	// frames that follow.
+	offset := fmt.Sprintf("%.2f", p.Duration.Seconds()/3)
+	if tr, ok := trace.FromContext(ctx); ok {
+		tr.LazyPrintf("Taking thumbnail at %ss...", offset)
+	}
+	err = writeAtomically(params["target"], func(path string) error {
+		return runCommand(ctx, nil, "ffmpeg", "-y", "-v", "error", "-nostats",
+			"-ss", offset,
+			"-i", params["source"],
+			"-vf", "thumbnail",
+			"-frames:v", "1",
+			"-f", "image2", "-c:v", "png",
+			path,
+		)
+	})
+	if err != nil || params["preview"] == "" {
+		return err
+	}
+	return writeAtomically(params["preview"], func(path string) error {
+		return runCommand(ctx, nil, "ffmpeg", "-y", "-v", "error", "-nostats",
+			"-ss", offset,
+			"-t", fmt.Sprintf("%.2f", kPreviewDuration.Seconds()),
+			"-i", params["source"],
+			"-vf", fmt.Sprintf("fps=%d,split[a][b];[a]palettegen[p];[b][p]paletteuse", kPreviewFPS),
+			"-loop", "0",
+			"-f", "gif",
+			path,
+		)
+	})
+}
+
+func (thumbnailHandler) Timeout() time.Duration {
+	return 10 * time.Minute
+}
+
+func (thumbnailHandler) Describe(params Params) string {
+	return fmt.Sprintf("Making thumbnail (%s -> %s)", params["source"], params["target"])
+}
+
+// writeAtomically lets write produce a file next to target, which then
+// replaces target, so that nobody sees it half written.
+func writeAtomically(target string, write func(string) error) error {
+	tmp := target + ".part"
+	if err := write(tmp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, target)
+}
@@ -5,344 +5,496 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/url"
-	"os"
-	"os/exec"
+	"sort"
 	"sync"
 	"time"
 
 	"github.com/golang/glog"
-	"github.com/jpillora/backoff"
 	"golang.org/x/net/context"
 	"golang.org/x/net/trace"
 )
 
 const (
-	kMaxWorkers      = 1024
-	kWorkQueueLength = 200
-)
-
-type WorkType int
-
-const (
-	WORK_REMOVE_FILE = iota
-	WORK_WEBDOWNLOAD = iota
-	WORK_CONVERT     = iota
+	kMaxWorkers = 1024
 )
 
 type WorkRequest struct {
-	Type     WorkType
+	// Name of the JobHandler running this request.
+	Type     string
+	Params   Params
+	Priority Priority
 	UID      int64
 	overlord *Overlord
 	context  context.Context
+	handler  JobHandler
 
 	// Dependency management
-	Depends *WorkRequest
-	Done    bool
-	Success bool
-	backoff backoff.Backoff
+	Depends []*WorkRequest
+	// Run even if any of Depends failed or got cancelled, eg. for cleanup.
+	AlwaysRun bool
+	Done      bool
+	Success   bool
+	Cancelled bool
+	// Attempts made so far, and the error of the last failed one.
+	Attempts  int
+	LastError *JobError
+	Created   time.Time
+	Finished  time.Time
+	cancel    context.CancelFunc
+	// How long the current attempt may take, zero if forever.
+	timeout time.Duration
+	// Requests depending on this one, and the number of unfinished
+	// requests this one depends on. Guarded by the Overlord's mutex.
+	dependents []*WorkRequest
+	waiting    int
+	// Pool, position in its ready queue and order of entering it. The index
+	// is -1 when not in a ready queue.
+	pool       *workerPool
+	readyIndex int
+	readySeq   int64
 
-	// Parameter
-	WebDownload struct {
-		VideoURL   *url.URL
-		TargetPath string
-	}
-	RemoveFile struct {
-		Path string
-	}
-	Convert struct {
-		SourcePath string
-		TargetPath string
-	}
+	// Progress and who to tell about it, see Subscribe.
+	progress      Progress
+	subscribers   []chan Event
+	progressMutex sync.Mutex
+	output        outputBuffer
 }
 
-func (r *WorkRequest) ScheduleDeletion() {
-	go func() {
-		time.Sleep(15 * time.Minute)
-		delete(r.overlord.workDirectory, r.UID)
-	}()
+// Description of the request in human terms, as given by its handler.
+func (r *WorkRequest) Description() string {
+	if r.handler == nil {
+		return describeParams(r.Type, r.Params)
+	}
+	return r.handler.Describe(r.Params)
 }
 
 // For JSON API
 type WorkStatus struct {
-	Type       string   `json:"type"`
-	UID        int64    `json:"uid"`
-	Depends    int64    `json:"depends"`
-	Done       bool     `json:"done"`
-	Success    bool     `json:"success"`
-	Parameters []string `json:"parameters"`
+	Type        string    `json:"type"`
+	Priority    string    `json:"priority"`
+	UID         int64     `json:"uid"`
+	Depends     []int64   `json:"depends"`
+	Done        bool      `json:"done"`
+	Success     bool      `json:"success"`
+	Cancelled   bool      `json:"cancelled"`
+	Progress    Progress  `json:"progress"`
+	Attempts    int       `json:"attempts"`
+	LastError   *JobError `json:"last_error"`
+	Description string    `json:"description"`
+	Parameters  Params    `json:"parameters"`
+	Created     time.Time `json:"created"`
+	Finished    time.Time `json:"finished"`
 }
 
 func (r *WorkRequest) getStatus() *WorkStatus {
-	var typeString string
-	var parameters []string
-	switch r.Type {
-	case WORK_REMOVE_FILE:
-		typeString = "remove_file"
-		parameters = []string{r.RemoveFile.Path}
-	case WORK_CONVERT:
-		typeString = "convert"
-		parameters = []string{r.Convert.SourcePath, r.Convert.TargetPath}
-	case WORK_WEBDOWNLOAD:
-		typeString = "web_download"
-		parameters = []string{r.WebDownload.VideoURL.String(), r.WebDownload.TargetPath}
-	default:
-		typeString = "unknown"
-		parameters = []string{}
-	}
-	var dependsInt int64
-	if r.Depends == nil {
-		dependsInt = 0
-	} else {
-		dependsInt = r.Depends.UID
+	depends := []int64{}
+	for _, d := range r.Depends {
+		depends = append(depends, d.UID)
 	}
 	s := &WorkStatus{
-		Type:       typeString,
-		UID:        r.UID,
-		Depends:    dependsInt,
-		Done:       r.Done,
-		Success:    r.Success,
-		Parameters: parameters,
+		Type:        r.Type,
+		Priority:    r.Priority.String(),
+		UID:         r.UID,
+		Depends:     depends,
+		Done:        r.Done,
+		Success:     r.Success,
+		Cancelled:   r.Cancelled,
+		Progress:    r.Progress(),
+		Attempts:    r.Attempts,
+		LastError:   r.LastError,
+		Description: r.Description(),
+		Parameters:  r.Params,
+		Created:     r.Created,
+		Finished:    r.Finished,
 	}
 	return s
 }
 
-type workerQueue chan chan *WorkRequest
-
 type Worker struct {
-	ID          int
-	Work        chan *WorkRequest
-	WorkerQueue workerQueue
-	QuitChan    chan bool
-	Current     *WorkRequest
-}
-
-func (w *Worker) handleWebDownload() error {
-	work := w.Current
-	tmpTargetPath := fmt.Sprintf("%s.temporary", work.WebDownload.TargetPath)
-	execCmd := fmt.Sprintf("mv {} %s", work.WebDownload.TargetPath)
-	args := []string{
-		work.WebDownload.VideoURL.String(),
-		"--max-downloads=1",
-		"-o", tmpTargetPath,
-		"--exec", execCmd,
-	}
-	if tr, ok := trace.FromContext(work.context); ok {
-		tr.LazyPrintf("Starting download %v...", args)
-	}
-	cmd := exec.Command("youtube-dl", args...)
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		return err
-	}
-	if tr, ok := trace.FromContext(work.context); ok {
-		tr.LazyPrintf("Command output: %v", string(out))
-	}
-	if !cmd.ProcessState.Success() {
-		errors.New("Process exited with non-zero status.")
-	}
-	return nil
-}
-
-func (w *Worker) handleRemoveFile() error {
-	work := w.Current
-	if tr, ok := trace.FromContext(work.context); ok {
-		tr.LazyPrintf("Removing file %s...", work.RemoveFile.Path)
-	}
-	os.Remove(work.RemoveFile.Path)
-	return nil
-}
-
-func (w *Worker) handleConvert() error {
-	work := w.Current
-	args := []string{
-		"-i", work.Convert.SourcePath,
-		"-vf", "scale=-2:128,crop=128:128",
-		"-c:v", "libvpx", "-b:v", "1M",
-		"-c:a", "libvorbis",
-		work.Convert.TargetPath,
-	}
-	if tr, ok := trace.FromContext(work.context); ok {
-		tr.LazyPrintf("Starting ffmpeg %v...", args)
-	}
-	cmd := exec.Command("ffmpeg", args...)
-	out, err := cmd.CombinedOutput()
-	if tr, ok := trace.FromContext(work.context); ok {
-		tr.LazyPrintf("Command output: %v", string(out))
-	}
-	if err != nil {
-		return err
-	}
-	return nil
+	ID int
+	// Name of the pool the worker belongs to, see Overlord.Resize.
+	Pool     string
+	Work     chan *WorkRequest
+	QuitChan chan bool
+	Current  *WorkRequest
+	finished chan workResult
 }
 
 func (w *Worker) Start() {
 	go func() {
 		for {
-			w.WorkerQueue <- w.Work
 			select {
+			case <-w.QuitChan:
+				return
 			case work := <-w.Work:
 				if tr, ok := trace.FromContext(work.context); ok {
 					tr.LazyPrintf("Hit worker %d", w.ID)
 				}
 				w.Current = work
-				var handler func() error
-				switch work.Type {
-				case WORK_WEBDOWNLOAD:
-					handler = w.handleWebDownload
-				case WORK_REMOVE_FILE:
-					handler = w.handleRemoveFile
-				case WORK_CONVERT:
-					handler = w.handleConvert
-				default:
-					handler = func() error { return nil }
+				ctx := context.WithValue(work.context, requestKey{}, work)
+				cancel := func() {}
+				if work.timeout != 0 {
+					ctx, cancel = context.WithTimeout(ctx, work.timeout)
 				}
-				if err := handler(); err != nil {
-					work.Success = false
-					glog.Error("Error running handler: %v", err)
+				err := work.handler.Run(ctx, work.Params)
+				if err != nil {
+					if work.context.Err() != nil {
+						err = fmt.Errorf("Cancelled (%v).", err)
+					} else if ctx.Err() != nil {
+						err = fmt.Errorf("Timed out after %v (%v).", work.timeout, err)
+					}
+					glog.Errorf("Error running handler: %v", err)
 					if tr, ok := trace.FromContext(work.context); ok {
 						tr.LazyPrintf("Error running handler: %v", err)
-						tr.SetError()
-						tr.Finish()
 					}
 				} else {
-					work.Success = true
 					if tr, ok := trace.FromContext(work.context); ok {
 						tr.LazyPrintf("Done.")
-						tr.Finish()
 					}
 				}
-				work.Done = true
-				work.ScheduleDeletion()
+				cancel()
+				w.Current = nil
+				w.finished <- workResult{request: work, worker: w, err: err}
 			}
-			w.Current = nil
 		}
 	}()
 }
 
 type Overlord struct {
-	workQueue   chan *WorkRequest
-	freeWorkers workerQueue
-	allWorkers  []*Worker
-	mutex       sync.RWMutex
-	currentUID  int64
+	// Visualizer used for audio-only sources, see IsVisualizer.
+	Visualizer string
+	// How long finished requests are kept around for inspection.
+	JournalRetention time.Duration
+	// Per job type timeouts, overriding the defaults of their handlers.
+	Timeouts map[string]time.Duration
+	// Limits for the commands run by jobs.
+	Limits Limits
+	// Conversion profiles by name, always including DefaultProfile.
+	Profiles map[string]Profile
+	// Whether videos converted with cropping profiles should follow the
+	// action rather than be cropped at the center, see analyzeCropHandler.
+	SmartCrop bool
 
+	pools        map[string]*workerPool
+	nextWorkerID int
+	mutex        sync.RWMutex
+	currentUID   int64
+
+	handlers      map[string]JobHandler
 	workDirectory map[int64]*WorkRequest
+	// Where requests are journaled, if anywhere. See OpenJournal.
+	journalDirectory string
+	// Order in which requests became runnable, see readyQueue.
+	readySeq int64
+	finished chan workResult
+	wake     chan bool
 }
 
-func NewOverlord() Overlord {
-	o := Overlord{
-		freeWorkers:   make(chan chan *WorkRequest, kMaxWorkers),
-		allWorkers:    []*Worker{},
-		workQueue:     make(chan *WorkRequest, kWorkQueueLength),
-		currentUID:    time.Now().UnixNano(),
-		workDirectory: make(map[int64]*WorkRequest),
+func NewOverlord() *Overlord {
+	o := &Overlord{
+		pools:            make(map[string]*workerPool),
+		Visualizer:       "spectrum",
+		JournalRetention: kDefaultJournalRetention,
+		Timeouts:         make(map[string]time.Duration),
+		Profiles:         DefaultProfiles(),
+		currentUID:       time.Now().UnixNano(),
+		handlers:         make(map[string]JobHandler),
+		workDirectory:    make(map[int64]*WorkRequest),
+		finished:         make(chan workResult, kMaxWorkers),
+		wake:             make(chan bool, 1),
+	}
+	for _, h := range builtinHandlers {
+		o.handlers[h.Name()] = h
 	}
 	return o
 }
 
-func (o *Overlord) NewRequest(ctx context.Context, t WorkType, f string, args ...interface{}) *WorkRequest {
+// NewRequest creates a request for a job of type t, to be scheduled with
+// Submit once its dependencies are filled in.
+func (o *Overlord) NewRequest(ctx context.Context, t string, params Params) *WorkRequest {
+	o.mutex.Lock()
 	uid := o.currentUID
 	o.currentUID++
-	n := fmt.Sprintf(f, args...)
+	handler := o.handlers[t]
+	o.mutex.Unlock()
+	ctx, cancel := context.WithCancel(ctx)
 	r := &WorkRequest{
-		Type:    t,
-		context: trace.NewContext(ctx, trace.New("webled.work", n)),
-		UID:     uid,
+		Type:       t,
+		Params:     params,
+		Priority:   PRIORITY_NORMAL,
+		readyIndex: -1,
+		handler:    handler,
+		Created:    time.Now(),
+		context:    trace.NewContext(ctx, trace.New("webled.work", describeParams(t, params))),
+		cancel:     cancel,
+		UID:        uid,
+		overlord:   o,
 	}
-	o.workDirectory[uid] = r
 	return r
 }
 
-func (o *Overlord) WebDownload(ctx context.Context, uri string, target string) ([]int64, error) {
+// checkRenditions makes sure renditions can be converted to.
+func (o *Overlord) checkRenditions(renditions []Rendition) error {
+	if len(renditions) == 0 {
+		return errors.New("No renditions requested.")
+	}
+	for _, r := range renditions {
+		if _, ok := o.Profiles[r.Profile]; !ok {
+			return fmt.Errorf("Unknown profile %q.", r.Profile)
+		}
+	}
+	return nil
+}
+
+// profileParams adds the named profile to the parameters of a conversion.
+func (o *Overlord) profileParams(name string, params Params) Params {
+	params["profile"] = name
+	return o.Profiles[name].params(params)
+}
+
+// WebDownload downloads a video and converts it into every rendition. Unless
+// loudness is empty, the audio is normalized and its measured Loudness kept
+// there. The UIDs returned are those of the download, followed by the
+// conversion of each rendition in order.
+func (o *Overlord) WebDownload(ctx context.Context, uri string, renditions []Rendition, loudness string, priority Priority) ([]int64, error) {
 	uriParsed, err := url.Parse(uri)
 	if err != nil {
 		return []int64{}, err
 	}
+	if err := o.checkRenditions(renditions); err != nil {
+		return []int64{}, err
+	}
 	tmpFileWeb, err := ioutil.TempFile("", "ledweb")
 	if err != nil {
 		return []int64{}, err
 	}
 	tmpWeb := tmpFileWeb.Name()
 
-	dlreq := o.NewRequest(ctx, WORK_WEBDOWNLOAD, "webdownload(%s, %s)", uriParsed.String(), tmpWeb)
-	dlreq.WebDownload.VideoURL = uriParsed
-	dlreq.WebDownload.TargetPath = tmpWeb
-	o.workQueue <- dlreq
+	dlreq := o.NewRequest(ctx, "web_download", Params{
+		"url":    uriParsed.String(),
+		"target": tmpWeb,
+	})
+
+	var measureReq *WorkRequest
+	if loudness != "" {
+		measureReq = o.NewRequest(ctx, "measure_loudness", Params{
+			"source": tmpWeb,
+			"target": loudness,
+		})
+		measureReq.Depends = []*WorkRequest{dlreq}
+	}
 
-	convertReq := o.NewRequest(ctx, WORK_CONVERT, "convert(%s, %s)", tmpWeb, target)
-	convertReq.Convert.SourcePath = tmpWeb
-	convertReq.Convert.TargetPath = target
-	convertReq.Depends = dlreq
-	o.workQueue <- convertReq
+	var analyzeReq *WorkRequest
+	tmpAnalysis := tmpWeb + ".crop.json"
+	reqs := []*WorkRequest{dlreq}
+	for _, rendition := range renditions {
+		params := o.profileParams(rendition.Profile, Params{
+			"source":     tmpWeb,
+			"target":     rendition.TargetPath,
+			"visualizer": o.Visualizer,
+		})
+		convertReq := o.NewRequest(ctx, "convert", params)
+		convertReq.Depends = []*WorkRequest{dlreq}
+		if measureReq != nil {
+			params["loudness"] = loudness
+			convertReq.Depends = append(convertReq.Depends, measureReq)
+		}
+		if o.SmartCrop && o.Profiles[rendition.Profile].Mode == "crop" {
+			if analyzeReq == nil {
+				analyzeReq = o.NewRequest(ctx, "analyze_crop", Params{
+					"source": tmpWeb,
+					"target": tmpAnalysis,
+				})
+				analyzeReq.Depends = []*WorkRequest{dlreq}
+			}
+			params["crop_analysis"] = tmpAnalysis
+			convertReq.Depends = append(convertReq.Depends, analyzeReq)
+		}
+		reqs = append(reqs, convertReq)
+	}
 
-	rmReq := o.NewRequest(ctx, WORK_REMOVE_FILE, "remove_file(%s)", tmpWeb)
-	rmReq.RemoveFile.Path = tmpWeb
-	rmReq.Depends = convertReq
-	o.workQueue <- rmReq
+	rmReq := o.NewRequest(ctx, "remove_file", Params{"path": tmpWeb})
+	rmReq.Depends = reqs[1:]
+	rmReq.AlwaysRun = true
+	extra := []*WorkRequest{rmReq}
+	// What a failed download leaves behind is kept for its retries, and only
+	// removed once it is done trying.
+	for _, partial := range []string{tmpWeb + ".temporary", tmpWeb + ".temporary.part"} {
+		rmPartialReq := o.NewRequest(ctx, "remove_file", Params{"path": partial})
+		rmPartialReq.Depends = []*WorkRequest{dlreq}
+		rmPartialReq.AlwaysRun = true
+		extra = append(extra, rmPartialReq)
+	}
+	if measureReq != nil {
+		extra = append(extra, measureReq)
+	}
+	if analyzeReq != nil {
+		rmAnalysisReq := o.NewRequest(ctx, "remove_file", Params{"path": tmpAnalysis})
+		rmAnalysisReq.Depends = reqs[1:]
+		rmAnalysisReq.AlwaysRun = true
+		extra = append(extra, analyzeReq, rmAnalysisReq)
+	}
 
-	return []int64{dlreq.UID, convertReq.UID}, nil
+	return o.submitChain(reqs, extra, priority)
 }
 
-func (o *Overlord) SpawnWorker() {
-	o.mutex.Lock()
-	defer o.mutex.Unlock()
-	newID := len(o.allWorkers)
-	w := Worker{
-		ID:          newID,
-		Work:        make(chan *WorkRequest, kWorkQueueLength),
-		WorkerQueue: o.freeWorkers,
-		QuitChan:    make(chan bool, 1),
-	}
-	o.allWorkers = append(o.allWorkers, &w)
-	w.Start()
+// submitChain submits a download and its conversions along with the extra
+// requests they need, eg. for cleanup, all at the given priority. It returns
+// the UIDs of reqs only.
+func (o *Overlord) submitChain(reqs []*WorkRequest, extra []*WorkRequest, priority Priority) ([]int64, error) {
+	all := append(append([]*WorkRequest{}, reqs...), extra...)
+	for _, r := range all {
+		r.Priority = priority
+	}
+	if err := o.Submit(all...); err != nil {
+		return []int64{}, err
+	}
+	uids := []int64{}
+	for _, r := range reqs {
+		uids = append(uids, r.UID)
+	}
+	return uids, nil
 }
 
-func (o *Overlord) StartDispatching() {
-	go func() {
-		for {
-			select {
-			case work := <-o.workQueue:
-				if work.Depends != nil && !work.Depends.Done {
-					if tr, ok := trace.FromContext(work.context); ok {
-						tr.LazyPrintf("Blocked on precondition...")
-					}
-					go func(w *WorkRequest) {
-						time.Sleep(w.backoff.Duration())
-						o.workQueue <- w
-					}(work)
-					continue
-				}
-				if work.Depends != nil && !work.Depends.Success {
-					if tr, ok := trace.FromContext(work.context); ok {
-						tr.LazyPrintf("Parent work failed, skipping.")
-					}
-					work.Done = true
-					work.Success = false
-					work.ScheduleDeletion()
-					continue
-				}
-				if tr, ok := trace.FromContext(work.context); ok {
-					tr.LazyPrintf("Dispatching...")
-				}
-				go func(w *WorkRequest) {
-					worker := <-o.freeWorkers
-					worker <- w
-				}(work)
+// ImageDownload downloads an image and converts it into a video of every
+// rendition. The UIDs returned are as for WebDownload.
+func (o *Overlord) ImageDownload(ctx context.Context, uri string, renditions []Rendition, duration time.Duration, priority Priority) ([]int64, error) {
+	uriParsed, err := url.Parse(uri)
+	if err != nil {
+		return []int64{}, err
+	}
+	if uriParsed.Scheme != "http" && uriParsed.Scheme != "https" {
+		return []int64{}, errors.New("Only HTTP(S) images are supported.")
+	}
+	if err := o.checkRenditions(renditions); err != nil {
+		return []int64{}, err
+	}
+	tmpFileImage, err := ioutil.TempFile("", "ledimage")
+	if err != nil {
+		return []int64{}, err
+	}
+	tmpImage := tmpFileImage.Name()
+	tmpFileImage.Close()
+
+	dlreq := o.NewRequest(ctx, "http_download", Params{
+		"url":    uriParsed.String(),
+		"target": tmpImage,
+	})
+
+	reqs := []*WorkRequest{dlreq}
+	for _, rendition := range renditions {
+		params := o.profileParams(rendition.Profile, Params{
+			"source":   tmpImage,
+			"target":   rendition.TargetPath,
+			"duration": duration.String(),
+		})
+		convertReq := o.NewRequest(ctx, "image_convert", params)
+		convertReq.Depends = []*WorkRequest{dlreq}
+		reqs = append(reqs, convertReq)
+	}
+
+	rmReq := o.NewRequest(ctx, "remove_file", Params{"path": tmpImage})
+	rmReq.Depends = reqs[1:]
+	rmReq.AlwaysRun = true
+
+	return o.submitChain(reqs, []*WorkRequest{rmReq}, priority)
+}
+
+// Thumbnail makes a thumbnail of the video at source, and unless preview is
+// empty an animated preview, once the requests after are done.
+func (o *Overlord) Thumbnail(ctx context.Context, source, target, preview string, after []int64, priority Priority) (int64, error) {
+	r := o.NewRequest(ctx, "thumbnail", Params{
+		"source":  source,
+		"target":  target,
+		"preview": preview,
+	})
+	r.Priority = priority
+	o.mutex.RLock()
+	for _, uid := range after {
+		d := o.workDirectory[uid]
+		if d == nil {
+			o.mutex.RUnlock()
+			return 0, fmt.Errorf("No such work %d.", uid)
+		}
+		r.Depends = append(r.Depends, d)
+	}
+	o.mutex.RUnlock()
+	if err := o.Submit(r); err != nil {
+		return 0, err
+	}
+	return r.UID, nil
+}
+
+// Cancel stops a request, along with everything that depends on it apart from
+// requests that always run.
+func (o *Overlord) Cancel(uid int64) error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	r := o.workDirectory[uid]
+	if r == nil {
+		return fmt.Errorf("No such work %d.", uid)
+	}
+	if r.Done {
+		return fmt.Errorf("Work %d already done.", uid)
+	}
+	cancelled := map[*WorkRequest]bool{r: true}
+	queue := []*WorkRequest{r}
+	for len(queue) > 0 {
+		c := queue[0]
+		queue = queue[1:]
+		for _, d := range c.dependents {
+			if cancelled[d] || d.AlwaysRun {
+				continue
 			}
+			cancelled[d] = true
+			queue = append(queue, d)
 		}
-	}()
+	}
+	for c := range cancelled {
+		if c.Done {
+			continue
+		}
+		if tr, ok := trace.FromContext(c.context); ok {
+			tr.LazyPrintf("Cancelling...")
+		}
+		c.Cancelled = true
+		c.cancel()
+		o.journal(c)
+	}
+	return nil
 }
 
 func (o *Overlord) GetWorkers() []Worker {
 	o.mutex.RLock()
 	defer o.mutex.RUnlock()
 	workers := []Worker{}
-	for _, worker := range o.allWorkers {
-		workers = append(workers, *worker)
+	for _, p := range o.pools {
+		for _, worker := range p.workers {
+			workers = append(workers, *worker)
+		}
 	}
+	sort.Slice(workers, func(i, j int) bool {
+		return workers[i].ID < workers[j].ID
+	})
 	return workers
 }
 
+// GetAllWorkStatus returns the status of all requests still tracked, oldest
+// first.
+func (o *Overlord) GetAllWorkStatus() []*WorkStatus {
+	o.mutex.RLock()
+	defer o.mutex.RUnlock()
+
+	ws := []*WorkStatus{}
+	for _, r := range o.workDirectory {
+		ws = append(ws, r.getStatus())
+	}
+	sort.Slice(ws, func(i, j int) bool {
+		return ws[i].UID < ws[j].UID
+	})
+	return ws
+}
+
 func (o *Overlord) GetWorkStatus(uids []int64) []*WorkStatus {
 	o.mutex.RLock()
 	defer o.mutex.RUnlock()